@@ -3,8 +3,8 @@ module ronce
 go 1.21.1
 
 require (
-	github.com/jmoiron/sqlx v1.3.5 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/oklog/ulid v1.3.1 // indirect
-	github.com/synthesio/zconfig v1.4.1 // indirect
+	github.com/jmoiron/sqlx v1.3.5
+	github.com/lib/pq v1.10.9
+	github.com/oklog/ulid v1.3.1
+	github.com/synthesio/zconfig v1.4.1
 )
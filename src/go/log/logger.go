@@ -67,9 +67,14 @@ func AddContextFields(ctx context.Context, keyvals []any) context.Context {
 	return context.WithValue(ctx, "log.fields", keyvals)
 }
 
+// ContextFields returns the fields added to the context by AddContextFields.
+func ContextFields(ctx context.Context) []any {
+	keyvals, _ := ctx.Value("log.fields").([]any)
+	return keyvals
+}
+
 // WithContext injects context loggable data into the logger.
 // It is similar to the package's function.
 func WithContext(ctx context.Context, logger *Logger) *Logger {
-	attrs, _ := ctx.Value("log.fields").([]any)
-	return logger.With(attrs...)
+	return logger.With(ContextFields(ctx)...)
 }
@@ -21,6 +21,8 @@ func In(query string, args ...any) (string, []any, error) {
 
 type NullTime = sql.NullTime
 
+type NullString = sql.NullString
+
 // Repeat the placeholders n times, separated by comas ','.
 func Repeat(placeholder string, n int) string {
 	out := strings.Repeat(placeholder+", ", n)
@@ -0,0 +1,85 @@
+package sql
+
+import (
+	"encoding"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ronce/src/go/errors"
+)
+
+// Keyed holds a setting per key, typically a lane or a job status. It is
+// configured as a comma-separated list of key:value pairs, like
+// "mail:4,media:1". The values are parsed with their UnmarshalText method if
+// they implement encoding.TextUnmarshaler, or as plain numbers and strings.
+type Keyed[T any] map[string]T
+
+// Get returns the value for the key, or def if the key isn't set.
+func (k Keyed[T]) Get(key string, def T) T {
+	v, ok := k[key]
+	if !ok {
+		return def
+	}
+	return v
+}
+
+func (k *Keyed[T]) UnmarshalText(raw []byte) error {
+	*k = make(Keyed[T])
+	for _, chunk := range strings.Split(string(raw), ",") {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(chunk, ":")
+		if !ok {
+			return errors.Newf(`invalid pair %q: expected key:value`, chunk)
+		}
+
+		var v T
+		err := parseValue(strings.TrimSpace(value), &v)
+		if err != nil {
+			return errors.Wrapf(err, `parsing value for key %q`, key)
+		}
+		(*k)[strings.TrimSpace(key)] = v
+	}
+	return nil
+}
+
+func (k Keyed[T]) MarshalText() ([]byte, error) {
+	var chunks []string
+	for key, v := range k {
+		var value string
+		switch v := any(v).(type) {
+		case encoding.TextMarshaler:
+			raw, err := v.MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			value = string(raw)
+		default:
+			value = fmt.Sprintf("%v", v)
+		}
+		chunks = append(chunks, key+":"+value)
+	}
+	return []byte(strings.Join(chunks, ",")), nil
+}
+
+func parseValue(raw string, dst any) (err error) {
+	switch dst := dst.(type) {
+	case encoding.TextUnmarshaler:
+		return dst.UnmarshalText([]byte(raw))
+	case *string:
+		*dst = raw
+	case *int:
+		*dst, err = strconv.Atoi(raw)
+	case *float64:
+		*dst, err = strconv.ParseFloat(raw, 64)
+	case *bool:
+		*dst, err = strconv.ParseBool(raw)
+	default:
+		return errors.Newf(`unsupported type %T`, dst)
+	}
+	return err
+}
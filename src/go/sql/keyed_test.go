@@ -0,0 +1,46 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+
+	"ronce/src/go/timex"
+)
+
+func TestKeyed_UnmarshalText(t *testing.T) {
+	type Case struct {
+		input string
+		want  Keyed[int]
+	}
+	for _, c := range []Case{
+		{``, Keyed[int]{}},
+		{`mail:4`, Keyed[int]{"mail": 4}},
+		{`mail:4,media:1`, Keyed[int]{"mail": 4, "media": 1}},
+		{` mail : 4 , media:1,`, Keyed[int]{"mail": 4, "media": 1}},
+	} {
+		var got Keyed[int]
+		if err := got.UnmarshalText([]byte(c.input)); err != nil {
+			t.Error(err)
+			t.Fail()
+		}
+		if !reflect.DeepEqual(c.want, got) {
+			t.Errorf("UnmarshalText(%q): want %v, got %v", c.input, c.want, got)
+			t.Fail()
+		}
+	}
+
+	var durations Keyed[timex.Duration]
+	if err := durations.UnmarshalText([]byte(`succeeded:168h,failed:2160h`)); err != nil {
+		t.Error(err)
+	}
+	if durations["succeeded"] != 168*timex.Hour || durations["failed"] != 2160*timex.Hour {
+		t.Errorf("UnmarshalText: unexpected durations %v", durations)
+	}
+
+	for _, input := range []string{`mail`, `mail:four`} {
+		var got Keyed[int]
+		if err := got.UnmarshalText([]byte(input)); err == nil {
+			t.Errorf("UnmarshalText(%q): expected an error", input)
+		}
+	}
+}
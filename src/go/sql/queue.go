@@ -5,20 +5,66 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"ronce/src/go/errors"
 	"ronce/src/go/log"
 	"ronce/src/go/timex"
 	"ronce/src/go/uuid"
+
+	"github.com/lib/pq"
 )
 
+// Queue consumes jobs stored as rows of a table. The table can hold any
+// business column, but must at least have the queue columns created by
+// CreateQueueTable. When History is set, every attempt is also recorded in
+// the <table>_attempts table, and when Dependencies is set, the parents of the
+// jobs are stored in the <table>_dependencies table. When Pausing is set, the
+// lanes paused in the <table>_lanes table are skipped. Use Queue.Check at
+// startup to validate the tables.
 type Queue struct {
 	Lanes     []string       `key:"lanes"     description:"lanes to consume"`
 	Heartbeat timex.Duration `key:"heartbeat" description:"heartbeat interval of the consumer worker"`
 	Timeout   timex.Duration `key:"timeout"   description:"timeout for running jobs to be claimable again"`
 	Tries     int            `key:"tries"     description:"maximum number of retries for processing an interrupted job before marking it failed"`
+
+	Concurrency     int        `key:"concurrency"      default:"1"    description:"maximum number of jobs processed in parallel"`
+	LaneConcurrency Keyed[int] `key:"lane-concurrency" default:""     description:"maximum number of jobs processed in parallel per lane, as lane:n pairs"`
+	Listen          bool       `key:"listen"           default:"true" description:"wake up on the notifications sent for new jobs instead of waiting for the heartbeat"`
+	ClaimBatch      int        `key:"claim-batch"      default:"10"   description:"maximum number of jobs claimed in a single query"`
+
+	LaneMaxRunning Keyed[int]  `key:"lane-max-running" default:"" description:"maximum number of jobs running at once per lane across all workers, as lane:n pairs"`
+	LaneRate       Keyed[Rate] `key:"lane-rate"        default:"" description:"maximum number of jobs started per period per lane across all workers, as lane:count/period pairs"`
+
+	Scheduling  string     `key:"scheduling"   default:"strict" description:"lane scheduling mode [strict, weighted]"`
+	LaneWeights Keyed[int] `key:"lane-weights" default:""       description:"share of the claims per lane in weighted mode, as lane:weight pairs"`
+
+	Grace       timex.Duration `key:"grace"        default:"0s" description:"time given to running jobs to finish on shutdown before releasing them"`
+	StatsWindow timex.Duration `key:"stats-window" default:"1h" description:"time window of the run durations and throughput computed by Stats"`
+
+	Retention         Keyed[timex.Duration] `key:"retention"          default:""      description:"time finished jobs are kept per status, as status:duration pairs"`
+	RetentionInterval timex.Duration        `key:"retention-interval" default:"1m"    description:"interval between two applications of the retention policy"`
+	RetentionBatch    int                   `key:"retention-batch"    default:"1000"  description:"maximum number of jobs removed at once by the retention policy"`
+	Archive           bool                  `key:"archive"            default:"false" description:"move the expired jobs to the <table>_archive table instead of deleting them"`
+
+	Retry     RetryPolicy        `key:"retry"`
+	LaneRetry Keyed[RetryPolicy] `key:"lane-retry" default:"" description:"retry policy per lane, as lane:attempts/delay/jitter/max-delay pairs"`
+
+	MaxRuntime     timex.Duration        `key:"max-runtime"      default:"0s" description:"maximum time a job can run before being cancelled as timed out, 0 for no limit"`
+	LaneMaxRuntime Keyed[timex.Duration] `key:"lane-max-runtime" default:""   description:"maximum runtime per lane, as lane:duration pairs"`
+
+	History      bool `key:"history"      default:"true" description:"record every job attempt in the <table>_attempts table"`
+	Dependencies bool `key:"dependencies" default:"true" description:"only run the jobs whose parents in the <table>_dependencies table succeeded"`
+	Pausing      bool `key:"pausing"      default:"true" description:"skip the lanes paused in the <table>_lanes table"`
+
+	// Middlewares wrap the runner of every job, and Hooks are called along
+	// the lifecycle of the jobs. They are set by the code, not configured.
+	Middlewares []Middleware
+	Hooks       Hooks
 }
 
 type Status string
@@ -31,6 +77,7 @@ const (
 	StatusCancelling Status = "cancelling"
 	StatusCancelled  Status = "cancelled"
 	StatusIgnored    Status = "ignored"
+	StatusTimedOut   Status = "timed_out"
 )
 
 type Job struct {
@@ -40,177 +87,754 @@ type Job struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
-type JobRunner = func(context.Context, *log.Logger, json.RawMessage) bool
+// JobRunner processes the payload of a job. A job returning an error is
+// retried according to the retry policy of its lane, unless the error is
+// marked with Permanent, or with Ignore to mark the job ignored.
+type JobRunner = func(context.Context, *log.Logger, json.RawMessage) error
+
+type enqueueOptions struct {
+	runAt        time.Time
+	delay        timex.Duration
+	dependencies []dependency
+	uniqueKey    string
+	uniqueWindow timex.Duration
+	priority     int
+	maxRuntime   timex.Duration
+}
+
+// newEnqueueOptions applies the options to a job enqueued at the given time.
+func newEnqueueOptions(now time.Time, opts []EnqueueOption) enqueueOptions {
+	var o enqueueOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.runAt.IsZero() {
+		o.runAt = now.Add(time.Duration(o.delay))
+	}
+	return o
+}
+
+// EnqueueOption customizes the job inserted by Queue.Enqueue.
+type EnqueueOption func(*enqueueOptions)
+
+// RunAt makes the job claimable only once the given time is reached.
+func RunAt(t time.Time) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.runAt = t
+	}
+}
+
+// Delay makes the job claimable only once the given duration has elapsed.
+func Delay(d timex.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.delay = d
+	}
+}
+
+// newJobRow returns the columns of a new job, the queue columns overriding the
+// ones of the payload.
+func newJobRow(ctx context.Context, id uuid.ID, lane string, payload any, now time.Time, o enqueueOptions) (map[string]any, error) {
+	row := make(map[string]any)
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, errors.Wrap(err, `marshalling payload`)
+		}
+		err = json.Unmarshal(raw, &row)
+		if err != nil {
+			return nil, errors.Wrap(err, `payload must marshal into a JSON object`)
+		}
+	}
+
+	row["id"] = id
+	row["lane"] = lane
+	row["status"] = StatusPending
+	row["try"] = 0
+	row["run_at"] = o.runAt
+	row["created_at"] = now
+	row["priority"] = o.priority
+	row["metadata"] = newJobMetadata(ctx)
+	if o.maxRuntime > 0 {
+		row["max_runtime"] = time.Duration(o.maxRuntime).Seconds()
+	}
+	if o.uniqueKey != "" {
+		row["unique_key"] = o.uniqueKey
+	}
+	return row, nil
+}
+
+// Enqueue inserts a pending job in the given lane of the table and returns its
+// id. The payload is marshalled into a JSON object whose keys are the columns
+// of the row, the queue columns being overridden by Enqueue itself. Columns
+// absent from the payload keep their default value. As it takes a Queryer, the
+// job can be enqueued in a transaction alongside the business writes. The log
+// fields of the context are stored in the metadata column, and restored in the
+// context of the runner.
+func (s Queue) Enqueue(ctx context.Context, q Queryer, table, lane string, payload any, opts ...EnqueueOption) (uuid.ID, error) {
+	now := time.Now()
+	o := newEnqueueOptions(now, opts)
+
+	// The job and its dependency edges must be committed together, otherwise
+	// the job could be claimed before its edges exist, or stay behind when
+	// they can't be inserted.
+	if db, ok := q.(*DB); ok && len(o.dependencies) != 0 {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return uuid.ID{}, errors.Wrap(err, `starting enqueue transaction`)
+		}
+		defer func() { _ = tx.Rollback() }()
+
+		id, err := s.Enqueue(ctx, tx, table, lane, payload, opts...)
+		if err != nil {
+			return uuid.ID{}, err
+		}
+		return id, errors.Wrap(tx.Commit(), `committing job`, `lane`, lane)
+	}
+
+	id := uuid.New()
+	row, err := newJobRow(ctx, id, lane, payload, now, o)
+	if err != nil {
+		return uuid.ID{}, err
+	}
+
+	if o.uniqueKey != "" {
+		// The unique index only covers the jobs that are not finished,
+		// so the finished jobs in the window have to be checked first.
+		if o.uniqueWindow > 0 {
+			existing, found, err := findUnique(ctx, q, table, o.uniqueKey, o.uniqueWindow)
+			if err != nil {
+				return uuid.ID{}, errors.Wrap(err, `looking up unique job`, `unique_key`, o.uniqueKey)
+			}
+			if found {
+				return existing, nil
+			}
+		}
+	}
+
+	raw, err := json.Marshal(row)
+	if err != nil {
+		return uuid.ID{}, errors.Wrap(err, `marshalling row`)
+	}
+
+	// Let Postgres convert the JSON values into the column types, and only
+	// insert the given columns so the other ones get their default value.
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, pq.QuoteIdentifier(column))
+	}
+	sort.Strings(columns)
+
+	insert := func() error {
+		_, err := q.Exec(ctx, fmt.Sprintf(`
+			insert into %[1]s (%[2]s)
+			select %[2]s
+			from jsonb_populate_record(null::%[1]s, ?::jsonb)
+		`, table, strings.Join(columns, ", ")), string(raw))
+		return err
+	}
+
+	if o.uniqueKey == "" {
+		err = insert()
+	} else {
+		var duplicate bool
+		duplicate, err = insertUnique(ctx, q, insert)
+		if duplicate {
+			existing, found, err := findUnique(ctx, q, table, o.uniqueKey, 0)
+			if err != nil {
+				return uuid.ID{}, errors.Wrap(err, `looking up unique job`, `unique_key`, o.uniqueKey)
+			}
+			if !found {
+				return uuid.ID{}, errors.New(`unique job finished while enqueuing`, `unique_key`, o.uniqueKey)
+			}
+			return existing, nil
+		}
+	}
+	if err != nil {
+		return uuid.ID{}, errors.Wrap(err, `inserting job`, `lane`, lane)
+	}
+
+	err = insertDependencies(ctx, q, table, id, o.dependencies)
+	if err != nil {
+		return uuid.ID{}, errors.Wrap(err, `inserting job dependencies`, `lane`, lane)
+	}
+
+	return id, nil
+}
 
+// Process consumes the jobs of the table in the configured lanes until the
+// context is cancelled. Up to Concurrency jobs are run in parallel, each with
+// its own heartbeat and cancellation. Once the context is cancelled, no job is
+// claimed anymore and the running jobs are given the Grace period to finish.
+// The ones still running are then cancelled and put back in the pending jobs.
+// Process returns once every running job has returned.
 func (s Queue) Process(ctx context.Context, logger *log.Logger, db *DB, table string, run JobRunner) {
+	err := s.checkRetention()
+	if err != nil {
+		logger.Error(`invalid queue configuration`, `err`, err)
+		return
+	}
+
+	p := processor{
+		Queue:   s,
+		logger:  logger,
+		db:      db,
+		table:   table,
+		run:     s.wrap(run),
+		running: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+	}
+
+	// Jobs run with a context detached from the app context, so they can
+	// be given a grace period to finish when the app shuts down.
+	jobsCtx, stopJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopJobs()
+
+	var wg sync.WaitGroup
+
+	// The retention policy is applied alongside the processing, and stops
+	// with the app context.
+	if len(s.Retention) != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.maintain(ctx)
+		}()
+	}
+
+	// Workers are woken up by the notifications sent on new jobs. The ticker
+	// stays as a fallback for missed notifications, and for reclaiming the
+	// running jobs whose heartbeat timed out.
+	var notifications <-chan *pq.Notification
+	if s.Listen {
+		var unlisten func()
+		notifications, unlisten = p.listen()
+		defer unlisten()
+	}
+
 	t := time.NewTicker(time.Duration(s.Heartbeat))
+	defer t.Stop()
 	for {
 		select {
 		case <-ctx.Done():
+			p.drain(&wg, stopJobs)
 			return
 		case <-t.C:
+		case <-p.wake:
+		case n := <-notifications:
+			// A nil notification is sent after the listener reconnected,
+			// in which case we may have missed some jobs.
+			if n != nil && !slices.Contains(s.Lanes, n.Extra) {
+				continue
+			}
 		}
 
-		var job struct {
-			Job
-			Payload json.RawMessage `db:"payload"` // payload is a jsonified SELECT * FROM table
-		}
-		now := time.Now()
-
-		// Select the first pending job, or running that exceeded the timeout. We
-		// have to use explicit locking in the subquery to avoid phantom reads. See
-		// https://www.postgresql.org/docs/15/transaction-iso.html and
-		// https://www.postgresql.org/docs/15/explicit-locking.html for details.
-		query, args, err := In(fmt.Sprintf(`
-			update %[1]s t
-			set status = ?,
-			    heartbeat_at = ?,
-				try = try + 1
-			where id in (
-				select id
-				from %[1]s
-				where lane in (?)
-				and (
-					status = ?
-					or (status = ? and heartbeat_at < ?)
-				)
-				order by array_position(array['%[2]s'], lane) asc, created_at asc
-				limit 1
-				for update
-			)
-			returning id, try, status, created_at, to_jsonb(t.*) as payload
-		`, table, strings.Join(s.Lanes, "','")),
-			StatusRunning,
-			now,
-			s.Lanes,
-			StatusPending,
-			StatusRunning,
-			now.Add(-time.Duration(s.Timeout)),
-		)
-		if err != nil {
-			logger.Error(`building job query`, `err`, err)
-			continue
+		// Claim jobs until either the pool is full or there is no job
+		// left to process in the lanes that still have room.
+		for {
+			lanes, room, free := p.available()
+			if len(lanes) == 0 {
+				break
+			}
+
+			jobs, err := p.claim(ctx, lanes, room, min(free, max(s.ClaimBatch, 1)))
+			if err != nil {
+				logger.Error(`retrieving jobs`, `err`, err)
+				break
+			}
+			if len(jobs) == 0 {
+				break
+			}
+
+			for _, job := range jobs {
+				job := job
+				p.acquire(job.Lane)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer p.release(job.Lane)
+					p.execute(jobsCtx, job)
+				}()
+			}
 		}
+	}
+}
 
-		err = db.Get(ctx, &job, query, args...)
-		if err == sql.ErrNoRows {
-			continue
+type claimedJob struct {
+	Job
+	Lane       string          `db:"lane"`
+	Payload    json.RawMessage `db:"payload"` // payload is a jsonified SELECT * FROM table
+	Checkpoint json.RawMessage `db:"checkpoint"`
+	MaxRuntime *float64        `db:"max_runtime"` // in seconds
+	Metadata   json.RawMessage `db:"metadata"`
+}
+
+// processor holds the state shared by the workers of a Process call.
+type processor struct {
+	Queue
+	logger *log.Logger
+	db     *DB
+	table  string
+	run    JobRunner
+
+	lock    sync.Mutex
+	running map[string]int
+	total   int
+
+	// wake is signaled when a worker becomes idle, so the next job can be
+	// claimed without waiting for the ticker.
+	wake chan struct{}
+}
+
+// available returns the lanes that can accept more jobs in priority order,
+// the number of jobs each of them can accept, and the number of jobs the pool
+// can accept overall.
+func (p *processor) available() (lanes []string, room map[string]int, free int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	free = max(p.Concurrency, 1) - p.total
+	if free <= 0 {
+		return nil, nil, 0
+	}
+
+	room = make(map[string]int, len(p.Lanes))
+	for _, lane := range p.Lanes {
+		r := free
+		if limit := p.LaneConcurrency.Get(lane, 0); limit > 0 {
+			r = min(r, limit-p.running[lane])
 		}
-		if err != nil {
-			logger.Error(`retrieving job`, `err`, err)
+		if r <= 0 {
 			continue
 		}
+		lanes = append(lanes, lane)
+		room[lane] = r
+	}
+	return lanes, room, free
+}
 
-		logger := logger.With(`job_id`, job.ID)
-
-		// We pre-increment the try counter in the job selection to avoid having to
-		// do another query, so we decrement it here for checking the limit. If a
-		// job has been interrupted more than the allowed number, mark it as failed.
-		// This is mainly a failsafe for jobs that break the execution environment,
-		// to avoid the retry mecanic to run wild.
-		if job.Try-1 > s.Tries {
-			job.Status = StatusFailed
-			logger.Debug(`updating job status`, `status`, job.Status)
-			_, err = db.Exec(ctx, fmt.Sprintf(`
-			update %[1]s
-			set status = ?
-			where id = ?
-		`, table), job.Status, job.ID)
-			if err != nil {
-				logger.Error(`updating job status`, `err`, err)
-				continue
-			}
+func (p *processor) acquire(lane string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running[lane]++
+	p.total++
+}
+
+func (p *processor) release(lane string) {
+	p.lock.Lock()
+	p.running[lane]--
+	p.total--
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// claim marks up to n pending jobs of the lanes as running and returns them,
+// without exceeding the room left in each lane nor its share of the claim in
+// weighted mode.
+func (p *processor) claim(ctx context.Context, lanes []string, room map[string]int, n int) ([]claimedJob, error) {
+	ordered, shares := p.shares(lanes, room, n)
+	jobs, err := p.claimShares(ctx, ordered, shares, n)
+	if err != nil || p.Scheduling != SchedulingWeighted || len(jobs) >= n {
+		return jobs, err
+	}
+
+	// The shares of the lanes short of jobs would be lost, leaving workers
+	// idle while other lanes have jobs: the rest of the claim goes to the
+	// lanes in their drawn order.
+	left := n - len(jobs)
+	more, err := p.claimShares(ctx, ordered, refill(ordered, room, jobs, left), left)
+	return append(jobs, more...), err
+}
+
+// claimShares marks up to n pending jobs as running and returns them, each
+// lane taking at most its share, in the given order of the lanes.
+func (p *processor) claimShares(ctx context.Context, ordered []string, shares map[string]int, n int) (jobs []claimedJob, err error) {
+	now := time.Now()
+
+	// Each lane takes at most its share of the jobs, in the claim order of
+	// the lanes.
+	var args []any
+	for i, lane := range ordered {
+		share := shares[lane]
+		if p.limited([]string{lane}) {
+			share = min(share, 1)
 		}
+		args = append(args, lane, share, i)
+	}
 
-		job.Status = StatusRunning
+	// Select the first pending jobs, or running that exceeded the timeout.
+	where := Where{
+		`j.lane = r.lane`,
+		`((j.status = ? and j.run_at <= ?) or (j.status = ? and j.heartbeat_at < ?))`,
+	}
+	args = append(args,
+		StatusPending,
+		now,
+		StatusRunning,
+		now.Add(-time.Duration(p.Timeout)),
+	)
 
-		// Derive the app context for this job, and cancel it if we
-		// detect that the job was cancelled. If the status changes for
-		// something unexpected, we stop the analysis and propagate the
-		// override.
-		jobCtx, cancel := context.WithCancel(ctx)
-		defer cancel()
+	// Pending jobs wait for all their parents to succeed, or to be
+	// finished for the dependencies ignoring the outcome of the parent.
+	if p.Dependencies {
+		where = append(where, fmt.Sprintf(`not exists (
+			select 1
+			from %[1]s d
+			join %[2]s parent on parent.id = d.parent_id
+			where d.job_id = j.id
+			and parent.status <> ?
+			and not (d.policy = ? and parent.status in (?))
+		)`, dependencyTable(p.table), p.table))
+		args = append(args, StatusSucceeded, DependencyIgnore, unsuccessfulStatuses)
+	}
 
-		go func() {
-			t := time.NewTicker(time.Duration(s.Heartbeat))
-			for {
-				select {
-				case <-jobCtx.Done():
-					logger.Debug(`closing monitoring routine`)
-					return
-				case <-t.C:
-				}
+	// The lanes paused at runtime are skipped until they are resumed.
+	if p.Pausing {
+		clause, clauseArgs := p.paused(p.table, now)
+		where = append(where, clause)
+		args = append(args, clauseArgs...)
+	}
 
-				var status Status
-				err = db.Get(ctx, &status, fmt.Sprintf(`
-					update %[1]s
-					set heartbeat_at = ?
-					where id = ?
-					returning status
-				`, table), time.Now(), job.ID)
-
-				// If the line can't be found anymore, this
-				// means the line was removed. Cancel the
-				// context and return to avoid leaks.
-				if errors.Is(err, sql.ErrNoRows) {
-					cancel()
-					return
-				}
+	// Lanes with cluster-wide limits only accept jobs while they are below
+	// their limits. As the limits are checked against the jobs running
+	// before the query, only one job of those lanes can be claimed at once.
+	limited := p.limited(ordered)
+	if limited {
+		clauses, clauseArgs := p.limits(p.table, ordered, now)
+		where = append(where, clauses...)
+		args = append(args, clauseArgs...)
+	}
 
-				if err != nil {
-					logger.Error(`monitoring job status`, `err`, err)
-					continue
-				}
+	args = append(args, n, StatusRunning, now, now)
+
+	// The candidates of each lane are locked while claiming them, skipping
+	// the ones already locked by concurrent workers rather than waiting for
+	// them. The first ones in the claim order of the lanes are kept.
+	query, args, err := In(fmt.Sprintf(`
+		with claimed as (
+			select c.id
+			from (values %[3]s) as r (lane, n, position)
+			cross join lateral (
+				select j.id, j.priority, j.created_at
+				from %[1]s j
+				%[2]s
+				order by j.priority desc, j.created_at asc
+				limit r.n
+				for update skip locked
+			) c
+			order by r.position asc, c.priority desc, c.created_at asc
+			limit ?
+		)
+		update %[1]s t
+		set status = ?,
+		    heartbeat_at = ?,
+		    started_at = ?,
+			try = try + 1
+		where id in (select id from claimed)
+		returning id, lane, try, status, created_at, checkpoint, max_runtime, metadata, to_jsonb(t.*) as payload
+	`, p.table, where, Repeat(`(?, ?::int, ?::int)`, len(ordered))), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, `building job query`)
+	}
+
+	if !limited {
+		err = p.db.Select(ctx, &jobs, query, args...)
+		return jobs, err
+	}
+
+	// Counting the jobs of the limited lanes and claiming must be atomic,
+	// otherwise concurrent workers could exceed the limits.
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, `starting claim transaction`)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	err = lockClaims(ctx, tx, p.table)
+	if err != nil {
+		return nil, errors.Wrap(err, `locking claims`)
+	}
 
-				switch status {
-				case StatusCancelling:
-					logger.Debug(`cancellation detected`)
-					cancel()
-				case StatusRunning:
-					continue
-				default:
-					job.Status = status
-					cancel()
-					continue
+	err = tx.Select(ctx, &jobs, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, errors.Wrap(tx.Commit(), `committing claim`)
+}
+
+// drain waits for the running jobs to return. Once the grace period is over,
+// the jobs still running are cancelled and released.
+func (p *processor) drain(wg *sync.WaitGroup, stopJobs func()) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(time.Duration(p.Grace))
+	defer t.Stop()
+	select {
+	case <-done:
+		return
+	case <-t.C:
+	}
+
+	p.logger.Info(`grace period elapsed, releasing running jobs`)
+	stopJobs()
+	<-done
+}
+
+// execute runs the claimed job and stores its final status. The context is
+// cancelled when the jobs must be released.
+func (p *processor) execute(ctx context.Context, job claimedJob) {
+	logger := p.logger.With(`job_id`, job.ID)
+
+	// The updates of the job must go through even once the job context is
+	// cancelled, otherwise released jobs would stay running until timeout.
+	dbCtx := context.WithoutCancel(ctx)
+
+	p.Hooks.claimed(ctx, job.Job)
+
+	// We pre-increment the try counter in the job selection to avoid having to
+	// do another query, so we decrement it here for checking the limit. If a
+	// job has been interrupted more than the allowed number on top of its
+	// attempts, mark it as failed. This is mainly a failsafe for jobs that
+	// break the execution environment, to avoid the retry mecanic to run wild.
+	policy := p.retryPolicy(job.Lane)
+	if job.Try-max(policy.Attempts, 1) > p.Tries {
+		o := outcome{
+			status: StatusFailed,
+			err:    errors.New(`too many interrupted tries`, `try`, job.Try),
+		}
+		p.finish(dbCtx, logger, job, o)
+		p.Hooks.concluded(dbCtx, job.Job, o)
+		return
+	}
+
+	// Derive the app context for this job, and cancel it if we
+	// detect that the job was cancelled. If the status changes for
+	// something unexpected, we stop the analysis and propagate the
+	// override.
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The maximum runtime only cancels the runner: the monitoring routine
+	// keeps going until the runner returns.
+	runCtx := jobCtx
+	if runtime := p.maxRuntime(job); runtime > 0 {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithTimeoutCause(jobCtx, runtime, errMaxRuntime)
+		defer cancelRun()
+	}
+
+	state := &jobState{job: job.Job, checkpoint: job.Checkpoint}
+	runCtx = withJobState(runCtx, state)
+
+	// The log fields of the enqueuer are restored, so the runner logs can
+	// be correlated with the request that enqueued the job.
+	runCtx, err := withJobMetadata(runCtx, job.Metadata)
+	if err != nil {
+		logger.Warn(`restoring job metadata`, `err`, err)
+	}
+
+	// The monitoring routine is the only one writing the override, and we
+	// only read it once the routine is done.
+	override := StatusRunning
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(time.Duration(p.Heartbeat))
+		defer t.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				logger.Debug(`closing monitoring routine`)
+				return
+			case <-t.C:
+			}
+
+			// The progress reported by the runner is written along
+			// with the heartbeat, to avoid another query.
+			progress, checkpoint := state.pending()
+
+			var status Status
+			err := p.db.Get(ctx, &status, fmt.Sprintf(`
+				update %[1]s
+				set heartbeat_at = ?,
+				    progress = coalesce(?, progress),
+				    checkpoint = coalesce(?::jsonb, checkpoint)
+				where id = ?
+				returning status
+			`, p.table), time.Now(), progress, checkpoint, job.ID)
+
+			// If the line can't be found anymore, this
+			// means the line was removed. Cancel the
+			// context and return to avoid leaks.
+			if errors.Is(err, sql.ErrNoRows) {
+				cancel()
+				return
+			}
+
+			if err != nil {
+				logger.Error(`monitoring job status`, `err`, err)
+				if progress != nil || checkpoint != nil {
+					state.retry()
 				}
+				continue
 			}
-		}()
 
-		ok := run(jobCtx, logger, job.Payload)
-		switch {
-		// If the status was manually overriden, log the event and skip
-		// the job.
-		case job.Status != StatusRunning:
-			logger.Warn(`unexpected status detected`, `status`, job.Status)
-			continue
+			switch status {
+			case StatusCancelling:
+				logger.Debug(`cancellation detected`)
+				cancel()
+			case StatusRunning:
+				continue
+			default:
+				override = status
+				cancel()
+				continue
+			}
+		}
+	}()
+
+	p.Hooks.started(runCtx, job.Job)
+	err = p.run(runCtx, logger, job.Payload)
+	interrupted := jobCtx.Err() != nil
+	timedOut := !interrupted && errors.Is(context.Cause(runCtx), errMaxRuntime)
+	cancel()
+	<-done
 
-		case ok:
-			job.Status = StatusSucceeded
+	progress, checkpoint := state.pending()
+	switch {
+	// If the status was manually overriden, log the event and skip
+	// the job.
+	case override != StatusRunning:
+		logger.Warn(`unexpected status detected`, `status`, override)
+		return
 
-		// If we have an error and the parent context is closed, we
-		// want to stop there and retry the job later, so we don't
-		// change the status of the job.
-		case ctx.Err() != nil:
-			break
+	// If we have an error and the parent context is closed, the
+	// app is shutting down and the grace period is over: release
+	// the job so another worker picks it up right away.
+	case err != nil && ctx.Err() != nil:
+		switch p.abandon(dbCtx, logger, job, progress, checkpoint) {
+		case StatusPending:
+			p.Hooks.abandoned(dbCtx, job.Job)
+			return
 
-		// If we have an error and the job context is closed, the job
-		// was cancelled by the user.
-		case jobCtx.Err() != nil:
-			job.Status = StatusCancelled
+		// The job was cancelled by the user before the monitoring
+		// routine noticed it: it is cancelled rather than released.
+		case StatusCancelling:
+			interrupted, timedOut = true, false
 
 		default:
-			job.Status = StatusFailed
+			return
 		}
+	}
+
+	o := p.conclude(logger, job.Lane, job.Try, err, interrupted, timedOut, time.Now())
+	state.lock.Lock()
+	o.result = state.result
+	state.lock.Unlock()
+	o.progress, o.checkpoint = progress, checkpoint
+
+	p.finish(dbCtx, logger, job, o)
+	p.Hooks.concluded(dbCtx, job.Job, o)
+}
+
+// conclude returns the outcome of a try of a job from the error returned by
+// its runner, applying the retry policy of its lane.
+func (s Queue) conclude(logger *log.Logger, lane string, try int, err error, interrupted, timedOut bool, now time.Time) outcome {
+	policy := s.retryPolicy(lane)
+	o := outcome{err: err}
+
+	switch {
+	case err == nil:
+		o.status = StatusSucceeded
 
-		logger.Debug(`updating job status`, `status`, job.Status)
-		_, err = db.Exec(ctx, fmt.Sprintf(`
+	// If we have an error and the job context is closed, the job
+	// was cancelled by the user.
+	case interrupted:
+		o.status = StatusCancelled
+
+	// If the job ran for too long, retry it like a failure but keep track
+	// of the timeout.
+	case timedOut && !IsPermanent(err) && try < policy.Attempts:
+		o.status, o.attempt = StatusPending, StatusTimedOut
+		o.runAt = now.Add(policy.Backoff(try))
+		logger.Warn(`job timed out, retrying`, `err`, err, `try`, try, `run_at`, o.runAt)
+
+	case timedOut:
+		logger.Error(`job timed out`, `err`, err, `try`, try)
+		o.status = StatusTimedOut
+
+	// If the runner doesn't want to process the job, there is no point
+	// in retrying it.
+	case IsIgnored(err):
+		logger.Warn(`job ignored`, `err`, err)
+		o.status = StatusIgnored
+
+	// If the job has attempts left, put it back in the queue once the
+	// backoff delay has elapsed.
+	case !IsPermanent(err) && try < policy.Attempts:
+		o.status, o.attempt = StatusPending, StatusFailed
+		o.runAt = now.Add(policy.Backoff(try))
+		logger.Warn(`job failed, retrying`, `err`, err, `try`, try, `run_at`, o.runAt)
+
+	default:
+		logger.Error(`job failed`, `err`, err, `try`, try)
+		o.status = StatusFailed
+	}
+	return o
+}
+
+// abandon puts the job back in the pending jobs without counting the
+// interrupted try. The progress and checkpoint reported since the last
+// heartbeat are kept, so the next worker resumes from there. Only running jobs
+// are released: abandon returns the status of the job, pending if it was
+// released, or empty if it couldn't be retrieved.
+func (p *processor) abandon(ctx context.Context, logger *log.Logger, job claimedJob, progress, checkpoint any) Status {
+	logger.Info(`releasing job`)
+
+	// The select runs on the snapshot taken before the update, so it
+	// returns the status of the job when it wasn't released.
+	var status Status
+	err := p.db.Get(ctx, &status, fmt.Sprintf(`
+		with released as (
 			update %[1]s
-			set status = ?
+			set status = ?,
+			    try = try - 1,
+			    heartbeat_at = null,
+			    progress = coalesce(?, progress),
+			    checkpoint = coalesce(?::jsonb, checkpoint)
 			where id = ?
-		`, table), job.Status, job.ID)
-		if err != nil {
-			logger.Error(`updating job status`, `err`, err)
-			continue
-		}
+			and status = ?
+			returning status
+		)
+		select status from released
+		union all
+		select status from %[1]s
+		where id = ?
+		and not exists (select 1 from released)
+	`, p.table), StatusPending, progress, checkpoint, job.ID, StatusRunning, job.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.Warn(`released job not found`)
+		return ""
+	}
+	if err != nil {
+		logger.Error(`releasing job`, `err`, err)
+		return ""
+	}
+	if status != StatusPending {
+		return status
+	}
+
+	err = Notify(ctx, p.db, p.table, job.Lane)
+	if err != nil {
+		logger.Error(`notifying released job`, `err`, err)
 	}
+	return status
 }
@@ -0,0 +1,299 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/timex"
+	"ronce/src/go/uuid"
+)
+
+// JobFilter selects jobs for the administration functions. Empty fields don't
+// filter anything.
+type JobFilter struct {
+	IDs       []uuid.ID
+	Lane      string
+	Statuses  []Status
+	OlderThan timex.Duration // only the jobs created before now - OlderThan
+}
+
+func (f JobFilter) where() (where Where, args []any) {
+	if len(f.IDs) != 0 {
+		where = append(where, `id in (?)`)
+		args = append(args, f.IDs)
+	}
+	if f.Lane != "" {
+		where = append(where, `lane = ?`)
+		args = append(args, f.Lane)
+	}
+	if len(f.Statuses) != 0 {
+		where = append(where, `status in (?)`)
+		args = append(args, f.Statuses)
+	}
+	if f.OlderThan > 0 {
+		where = append(where, `created_at < ?`)
+		args = append(args, time.Now().Add(-time.Duration(f.OlderThan)))
+	}
+	return where, args
+}
+
+// JobInfo is the queue state of a job.
+type JobInfo struct {
+	ID         uuid.ID    `db:"id"`
+	Lane       string     `db:"lane"`
+	Status     Status     `db:"status"`
+	Try        int        `db:"try"`
+	CreatedAt  time.Time  `db:"created_at"`
+	RunAt      time.Time  `db:"run_at"`
+	StartedAt  NullTime   `db:"started_at"`
+	FinishedAt NullTime   `db:"finished_at"`
+	LastError  NullString `db:"last_error"`
+}
+
+// Attempt is a try of a job, as recorded in the attempts history table.
+type Attempt struct {
+	Try          int             `db:"try"`
+	Status       Status          `db:"status"`
+	Error        NullString      `db:"error"`
+	ErrorContext json.RawMessage `db:"error_context"`
+	StartedAt    NullTime        `db:"started_at"`
+	FinishedAt   time.Time       `db:"finished_at"`
+}
+
+// JobDetails is the full state of a job, including its row and attempts.
+type JobDetails struct {
+	JobInfo
+	Row      json.RawMessage `db:"row"`
+	Attempts []Attempt       `db:"-"`
+}
+
+const jobInfoColumns = `id, lane, status, try, created_at, run_at, started_at, finished_at, last_error`
+
+// List returns the jobs of the table matching the filter, oldest first, up to
+// limit jobs.
+func (s Queue) List(ctx context.Context, q Queryer, table string, filter JobFilter, limit int) ([]JobInfo, error) {
+	where, args := filter.where()
+	query, args, err := In(fmt.Sprintf(`
+		select %s
+		from %s
+		%s
+		order by created_at asc
+		limit ?
+	`, jobInfoColumns, table, where), append(args, limit)...)
+	if err != nil {
+		return nil, errors.Wrap(err, `building list query`)
+	}
+
+	var jobs []JobInfo
+	err = q.Select(ctx, &jobs, query, args...)
+	return jobs, errors.Wrap(err, `listing jobs`, `table`, table)
+}
+
+// Inspect returns the details of the job, with its attempts if History is
+// set.
+func (s Queue) Inspect(ctx context.Context, q Queryer, table string, id uuid.ID) (job JobDetails, err error) {
+	err = q.Get(ctx, &job, fmt.Sprintf(`
+		select %s, to_jsonb(t.*) as row
+		from %s t
+		where id = ?
+	`, jobInfoColumns, table), id)
+	if err != nil {
+		return job, errors.Wrap(err, `retrieving job`, `job_id`, id)
+	}
+
+	if !s.History {
+		return job, nil
+	}
+
+	err = q.Select(ctx, &job.Attempts, fmt.Sprintf(`
+		select try, status, error, error_context, started_at, finished_at
+		from %s
+		where job_id = ?
+		order by try asc, finished_at asc
+	`, historyTable(table)), id)
+	return job, errors.Wrap(err, `retrieving job attempts`, `job_id`, id)
+}
+
+// CancelJobs cancels the jobs matching the filter. The pending jobs are
+// cancelled directly, while the running ones are marked cancelling: their
+// worker cancels the job context at its next heartbeat and marks them
+// cancelled once the runner returned. It returns the number of jobs affected.
+func (s Queue) CancelJobs(ctx context.Context, q Queryer, table string, filter JobFilter) (int64, error) {
+	where, args := filter.where()
+
+	query, pendingArgs, err := In(fmt.Sprintf(`
+		update %s
+		set status = ?,
+		    finished_at = now()
+		where id in (select id from %s %s)
+		and status = ?
+		returning id
+	`, table, table, where), append(append([]any{StatusCancelled}, args...), StatusPending)...)
+	if err != nil {
+		return 0, errors.Wrap(err, `building cancel query`)
+	}
+
+	var cancelled []uuid.ID
+	err = q.Select(ctx, &cancelled, query, pendingArgs...)
+	if err != nil {
+		return 0, errors.Wrap(err, `cancelling pending jobs`, `table`, table)
+	}
+
+	if s.Dependencies {
+		for _, id := range cancelled {
+			err = cascadeDependencies(ctx, q, table, id)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	query, runningArgs, err := In(fmt.Sprintf(`
+		update %s
+		set status = ?
+		where id in (select id from %s %s)
+		and status = ?
+	`, table, table, where), append(append([]any{StatusCancelling}, args...), StatusRunning)...)
+	if err != nil {
+		return 0, errors.Wrap(err, `building cancel query`)
+	}
+
+	res, err := q.Exec(ctx, query, runningArgs...)
+	if err != nil {
+		return 0, errors.Wrap(err, `cancelling running jobs`, `table`, table)
+	}
+	n, _ := res.RowsAffected()
+	return int64(len(cancelled)) + n, nil
+}
+
+// Cancel cancels the job and returns its status. A pending job is cancelled
+// directly, while a running job is marked cancelling for its worker to cancel
+// the job context at its next heartbeat. When wait is set, Cancel then polls
+// the job until it reaches a final status, which is not necessarily cancelled
+// if the runner finished anyway, or until the context expires.
+func (s Queue) Cancel(ctx context.Context, db *DB, table string, id uuid.ID, wait bool) (Status, error) {
+	_, err := s.CancelJobs(ctx, db, table, JobFilter{IDs: []uuid.ID{id}})
+	if err != nil {
+		return "", err
+	}
+
+	interval := time.Duration(s.Heartbeat)
+	if interval <= 0 {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		var status Status
+		err = db.Get(ctx, &status, fmt.Sprintf(`select status from %s where id = ?`, table), id)
+		if err != nil {
+			return "", errors.Wrap(err, `retrieving job status`, `job_id`, id)
+		}
+		if !wait || !slices.Contains(activeStatuses, status) {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, errors.Wrap(ctx.Err(), `waiting for job cancellation`, `job_id`, id, `status`, status)
+		case <-t.C:
+		}
+	}
+}
+
+// RetryJobs puts the unsuccessful jobs matching the filter back in the
+// pending jobs, claimable right away and with a fresh try counter, error and
+// progress. The succeeded jobs are left untouched. It returns the number of
+// jobs affected.
+func (s Queue) RetryJobs(ctx context.Context, q Queryer, table string, filter JobFilter) (int64, error) {
+	where, args := filter.where()
+	query, args, err := In(fmt.Sprintf(`
+		update %s
+		set status = ?,
+		    try = 0,
+		    run_at = now(),
+		    started_at = null,
+		    finished_at = null,
+		    last_error = null,
+		    error_context = null,
+		    progress = null,
+		    checkpoint = null
+		where id in (select id from %s %s)
+		and status in (?)
+		returning lane
+	`, table, table, where), append(append([]any{StatusPending}, args...), unsuccessfulStatuses)...)
+	if err != nil {
+		return 0, errors.Wrap(err, `building retry query`)
+	}
+
+	var lanes []string
+	err = q.Select(ctx, &lanes, query, args...)
+	if err != nil {
+		return 0, errors.Wrap(err, `retrying jobs`, `table`, table)
+	}
+
+	notified := make(map[string]bool)
+	for _, lane := range lanes {
+		if notified[lane] {
+			continue
+		}
+		notified[lane] = true
+		err = Notify(ctx, q, table, lane)
+		if err != nil {
+			return 0, errors.Wrap(err, `notifying jobs`, `lane`, lane)
+		}
+	}
+	return int64(len(lanes)), nil
+}
+
+// RelaneJobs moves the jobs matching the filter that are not running to the
+// lane. It returns the number of jobs affected.
+func (s Queue) RelaneJobs(ctx context.Context, q Queryer, table string, filter JobFilter, lane string) (int64, error) {
+	where, args := filter.where()
+	query, args, err := In(fmt.Sprintf(`
+		update %s
+		set lane = ?
+		where id in (select id from %s %s)
+		and status not in (?)
+	`, table, table, where), append(append([]any{lane}, args...), []Status{StatusRunning, StatusCancelling})...)
+	if err != nil {
+		return 0, errors.Wrap(err, `building relane query`)
+	}
+
+	res, err := q.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, errors.Wrap(err, `relaning jobs`, `table`, table)
+	}
+
+	err = Notify(ctx, q, table, lane)
+	if err != nil {
+		return 0, errors.Wrap(err, `notifying jobs`, `lane`, lane)
+	}
+
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// PurgeJobs deletes the finished jobs matching the filter. It returns the
+// number of jobs deleted.
+func (s Queue) PurgeJobs(ctx context.Context, q Queryer, table string, filter JobFilter) (int64, error) {
+	where, args := filter.where()
+	where = append(where, `status not in (?)`)
+	args = append(args, activeStatuses)
+
+	query, args, err := In(fmt.Sprintf(`delete from %s %s`, table, where), args...)
+	if err != nil {
+		return 0, errors.Wrap(err, `building purge query`)
+	}
+
+	res, err := q.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, errors.Wrap(err, `purging jobs`, `table`, table)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
@@ -0,0 +1,60 @@
+package sql
+
+import (
+	"context"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+	"ronce/src/go/uuid"
+)
+
+// JobQueue stores and processes the jobs of a queue. PostgresQueue is the
+// production backend, while MemoryQueue keeps the jobs in memory for unit
+// tests. Both follow the same status transitions.
+type JobQueue interface {
+	// Enqueue adds a pending job to the lane and returns its id.
+	Enqueue(ctx context.Context, lane string, payload any, opts ...EnqueueOption) (uuid.ID, error)
+	// Process runs the jobs until the context is cancelled.
+	Process(ctx context.Context, logger *log.Logger, run JobRunner)
+	// Job returns the queue state of the job.
+	Job(ctx context.Context, id uuid.ID) (JobInfo, error)
+	// Cancel cancels the job if it is pending, or asks its runner to stop
+	// if it is running. Finished jobs are left untouched.
+	Cancel(ctx context.Context, id uuid.ID) error
+}
+
+var (
+	_ JobQueue = PostgresQueue{}
+	_ JobQueue = (*MemoryQueue)(nil)
+)
+
+// PostgresQueue is the JobQueue storing the jobs in a queue table.
+type PostgresQueue struct {
+	Queue Queue
+	DB    *DB
+	Table string
+}
+
+func (q PostgresQueue) Enqueue(ctx context.Context, lane string, payload any, opts ...EnqueueOption) (uuid.ID, error) {
+	return q.Queue.Enqueue(ctx, q.DB, q.Table, lane, payload, opts...)
+}
+
+func (q PostgresQueue) Process(ctx context.Context, logger *log.Logger, run JobRunner) {
+	q.Queue.Process(ctx, logger, q.DB, q.Table, run)
+}
+
+func (q PostgresQueue) Job(ctx context.Context, id uuid.ID) (JobInfo, error) {
+	jobs, err := q.Queue.List(ctx, q.DB, q.Table, JobFilter{IDs: []uuid.ID{id}}, 1)
+	if err != nil {
+		return JobInfo{}, err
+	}
+	if len(jobs) == 0 {
+		return JobInfo{}, errors.Wrap(ErrNoRows, `retrieving job`, `job_id`, id)
+	}
+	return jobs[0], nil
+}
+
+func (q PostgresQueue) Cancel(ctx context.Context, id uuid.ID) error {
+	_, err := q.Queue.Cancel(ctx, q.DB, q.Table, id, false)
+	return err
+}
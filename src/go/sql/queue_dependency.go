@@ -0,0 +1,158 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/uuid"
+)
+
+// DependencyPolicy defines what happens to a pending job when one of its
+// parents doesn't succeed.
+type DependencyPolicy string
+
+const (
+	// DependencyCancel cancels the job when the parent fails or is
+	// cancelled.
+	DependencyCancel DependencyPolicy = "cancel"
+	// DependencyFail marks the job failed when the parent fails or is
+	// cancelled.
+	DependencyFail DependencyPolicy = "fail"
+	// DependencyIgnore runs the job once the parent is finished, whatever
+	// its outcome.
+	DependencyIgnore DependencyPolicy = "ignore"
+)
+
+// unsuccessfulStatuses are the final statuses of the jobs that didn't
+// succeed, and which are cascaded to their dependents.
+var unsuccessfulStatuses = []Status{StatusFailed, StatusCancelled, StatusIgnored, StatusTimedOut}
+
+func isUnsuccessful(status Status) bool {
+	for _, s := range unsuccessfulStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type dependency struct {
+	parent uuid.ID
+	policy DependencyPolicy
+}
+
+// DependsOn makes the job claimable only once all the parents succeeded. The
+// policy decides what happens to the job if a parent fails or is cancelled.
+// It can be given several times to mix policies, typically for fan-in jobs.
+func DependsOn(policy DependencyPolicy, parents ...uuid.ID) EnqueueOption {
+	return func(o *enqueueOptions) {
+		for _, parent := range parents {
+			o.dependencies = append(o.dependencies, dependency{parent, policy})
+		}
+	}
+}
+
+// dependencyTable returns the name of the table holding the edges between the
+// jobs of the table and their parents.
+func dependencyTable(table string) string {
+	return table + "_dependencies"
+}
+
+// insertDependencies stores the parents of the job. If a parent is already
+// unsuccessful, its status is cascaded right away. The parents are locked
+// first, so a parent finishing concurrently waits for the edges to be
+// committed and cascades its status to the job.
+func insertDependencies(ctx context.Context, q Queryer, table string, id uuid.ID, dependencies []dependency) error {
+	if len(dependencies) == 0 {
+		return nil
+	}
+
+	args := make([]any, 0, 3*len(dependencies))
+	parents := make([]uuid.ID, 0, len(dependencies))
+	for _, d := range dependencies {
+		args = append(args, id, d.parent, d.policy)
+		parents = append(parents, d.parent)
+	}
+
+	query, lockArgs, err := In(fmt.Sprintf(`
+		select id, status
+		from %s
+		where id in (?)
+		order by id
+		for share
+	`, table), parents)
+	if err != nil {
+		return err
+	}
+
+	var locked []struct {
+		ID     uuid.ID `db:"id"`
+		Status Status  `db:"status"`
+	}
+	err = q.Select(ctx, &locked, query, lockArgs...)
+	if err != nil {
+		return errors.Wrap(err, `locking parent jobs`)
+	}
+
+	_, err = q.Exec(ctx, fmt.Sprintf(`
+		insert into %s (job_id, parent_id, policy)
+		values %s
+	`, dependencyTable(table), Repeat(`(?, ?, ?)`, len(dependencies))), args...)
+	if err != nil {
+		return err
+	}
+
+	for _, parent := range locked {
+		if !isUnsuccessful(parent.Status) {
+			continue
+		}
+		err = cascadeDependencies(ctx, q, table, parent.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cascadeDependencies marks the pending dependents of the unsuccessful job as
+// cancelled or failed depending on the policy of their edge, recursively. The
+// dependents ignoring the outcome of their parents are left untouched, as
+// well as their own dependents.
+func cascadeDependencies(ctx context.Context, q Queryer, table string, id uuid.ID) error {
+	// A job can be reached through several edges with different policies,
+	// in which case failing takes precedence. The two updates must touch
+	// distinct rows since they run on the same snapshot.
+	_, err := q.Exec(ctx, fmt.Sprintf(`
+		with recursive cascade (id, policy) as (
+			select job_id, policy
+			from %[2]s
+			where parent_id = ?
+			and policy <> ?
+			union
+			select d.job_id, d.policy
+			from %[2]s d
+			join cascade c on d.parent_id = c.id
+			where d.policy <> ?
+		), failed as (
+			update %[1]s t
+			set status = ?,
+			    last_error = ?,
+			    finished_at = now()
+			where t.status = ?
+			and t.id in (select id from cascade where policy = ?)
+		)
+		update %[1]s t
+		set status = ?,
+		    last_error = ?,
+		    finished_at = now()
+		where t.status = ?
+		and t.id in (select id from cascade)
+		and t.id not in (select id from cascade where policy = ?)
+	`, table, dependencyTable(table)),
+		id, DependencyIgnore, DependencyIgnore,
+		StatusFailed, `parent job did not succeed`, StatusPending, DependencyFail,
+		StatusCancelled, `parent job did not succeed`, StatusPending, DependencyFail,
+	)
+	return errors.Wrap(err, `cascading job status to dependents`, `job_id`, id)
+}
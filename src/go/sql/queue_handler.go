@@ -0,0 +1,33 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+)
+
+// Handle returns a JobRunner decoding the payload of the jobs into T before
+// calling fn. As the payload is the JSON representation of the job row, T is
+// typically a struct with json tags matching the columns of the table. A
+// payload that can't be decoded fails the job permanently.
+func Handle[T any](fn func(context.Context, *log.Logger, T) error) JobRunner {
+	return func(ctx context.Context, logger *log.Logger, payload json.RawMessage) error {
+		var v T
+		err := json.Unmarshal(payload, &v)
+		if err != nil {
+			return Permanent(errors.Wrapf(err, `decoding payload into %T`, v))
+		}
+		return fn(ctx, logger, v)
+	}
+}
+
+// JobFromContext returns the job running with the context.
+func JobFromContext(ctx context.Context) (Job, bool) {
+	state, ok := jobStateFrom(ctx)
+	if !ok {
+		return Job{}, false
+	}
+	return state.job, true
+}
@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"ronce/src/go/log"
+	"ronce/src/go/uuid"
+)
+
+func TestHandle(t *testing.T) {
+	type House struct {
+		ID   uuid.ID `json:"id"`
+		Name string  `json:"name"`
+	}
+
+	id := uuid.New()
+	job := Job{ID: id, Try: 2, Status: StatusRunning}
+	ctx := withJobState(context.Background(), &jobState{job: job})
+
+	var got House
+	var gotJob Job
+	run := Handle(func(ctx context.Context, logger *log.Logger, h House) error {
+		got = h
+		gotJob, _ = JobFromContext(ctx)
+		return nil
+	})
+
+	payload, _ := json.Marshal(map[string]any{"id": id, "name": "tiny house", "lane": "default"})
+	if err := run(ctx, log.New(), payload); err != nil {
+		t.Fatalf("Handle: unexpected error %s", err)
+	}
+	if want := (House{ID: id, Name: "tiny house"}); got != want {
+		t.Errorf("Handle: want %v, got %v", want, got)
+	}
+	if gotJob != job {
+		t.Errorf("JobFromContext: want %v, got %v", job, gotJob)
+	}
+
+	err := run(ctx, log.New(), json.RawMessage(`{"name": 42}`))
+	if !IsPermanent(err) {
+		t.Errorf("Handle: want a permanent error on invalid payload, got %v", err)
+	}
+
+	if _, ok := JobFromContext(context.Background()); ok {
+		t.Errorf("JobFromContext: want no job outside of a job context")
+	}
+}
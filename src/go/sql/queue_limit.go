@@ -0,0 +1,88 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/timex"
+)
+
+// Rate is a maximum number of events per period, written like 100/1m.
+type Rate struct {
+	Count  int
+	Period timex.Duration
+}
+
+func (r *Rate) UnmarshalText(raw []byte) (err error) {
+	count, period, ok := strings.Cut(string(raw), "/")
+	if !ok {
+		return errors.Newf(`invalid rate %q: expected count/period`, raw)
+	}
+
+	r.Count, err = strconv.Atoi(count)
+	if err != nil {
+		return errors.Wrap(err, `parsing rate count`)
+	}
+	err = r.Period.UnmarshalText([]byte(period))
+	if err != nil {
+		return errors.Wrap(err, `parsing rate period`)
+	}
+	return nil
+}
+
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf(`%d/%s`, r.Count, r.Period)), nil
+}
+
+// limited reports whether any of the lanes has a cluster-wide limit.
+func (s Queue) limited(lanes []string) bool {
+	for _, lane := range lanes {
+		if _, ok := s.LaneMaxRunning[lane]; ok {
+			return true
+		}
+		if _, ok := s.LaneRate[lane]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// limits returns the conditions excluding the jobs of the lanes that reached
+// their cluster-wide limits, along with their arguments. The running jobs
+// whose heartbeat timed out don't count, as they are considered abandoned.
+func (s Queue) limits(table string, lanes []string, now time.Time) (where Where, args []any) {
+	for _, lane := range lanes {
+		if n, ok := s.LaneMaxRunning[lane]; ok {
+			where = append(where, fmt.Sprintf(`(j.lane <> ? or (
+				select count(*)
+				from %s r
+				where r.lane = ?
+				and r.status in (?)
+				and r.heartbeat_at >= ?
+			) < ?)`, table))
+			args = append(args, lane, lane, []Status{StatusRunning, StatusCancelling}, now.Add(-time.Duration(s.Timeout)), n)
+		}
+
+		if rate, ok := s.LaneRate[lane]; ok {
+			where = append(where, fmt.Sprintf(`(j.lane <> ? or (
+				select count(*)
+				from %s r
+				where r.lane = ?
+				and r.started_at > ?
+			) < ?)`, table))
+			args = append(args, lane, lane, now.Add(-time.Duration(rate.Period)), rate.Count)
+		}
+	}
+	return where, args
+}
+
+// lockClaims serializes the claims on the table for the duration of the
+// transaction, so the cluster-wide limits hold between concurrent workers.
+func lockClaims(ctx context.Context, tx *Tx, table string) error {
+	_, err := tx.Exec(ctx, `select pg_advisory_xact_lock(hashtext(?))`, "queue:"+table)
+	return err
+}
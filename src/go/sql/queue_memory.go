@@ -0,0 +1,297 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+	"ronce/src/go/timex"
+	"ronce/src/go/uuid"
+)
+
+// MemoryQueue is a JobQueue keeping the jobs in memory, for unit tests. The
+// time is read from its clock, so a test can run the jobs due with RunDue and
+// move a timex.ManualClock forward to trigger the delayed jobs and the retries,
+// without sleeping.
+//
+// It applies the lanes, priorities, retry policies and unique keys of the
+// Queue, but runs the jobs one at a time and doesn't support dependencies nor
+// the limits and maximum runtimes.
+type MemoryQueue struct {
+	Queue Queue
+	Clock timex.Clock
+
+	lock sync.Mutex
+	jobs []*memoryJob // in enqueue order
+	wake chan struct{}
+}
+
+type memoryJob struct {
+	JobInfo
+	row       map[string]any
+	priority  int
+	uniqueKey string
+	result    json.RawMessage
+	cancel    context.CancelFunc // set while running
+}
+
+func NewMemoryQueue(s Queue, clock timex.Clock) *MemoryQueue {
+	return &MemoryQueue{
+		Queue: s,
+		Clock: clock,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func (m *MemoryQueue) Enqueue(ctx context.Context, lane string, payload any, opts ...EnqueueOption) (uuid.ID, error) {
+	now := m.Clock.Now()
+	o := newEnqueueOptions(now, opts)
+	if len(o.dependencies) != 0 {
+		return uuid.ID{}, errors.New(`dependencies are not supported by the memory queue`)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if o.uniqueKey != "" {
+		for _, job := range m.jobs {
+			if job.uniqueKey != o.uniqueKey {
+				continue
+			}
+			if slices.Contains(activeStatuses, job.Status) ||
+				(o.uniqueWindow > 0 && job.FinishedAt.Valid && now.Sub(job.FinishedAt.Time) < time.Duration(o.uniqueWindow)) {
+				return job.ID, nil
+			}
+		}
+	}
+
+	id := uuid.New()
+	row, err := newJobRow(ctx, id, lane, payload, now, o)
+	if err != nil {
+		return uuid.ID{}, err
+	}
+
+	m.jobs = append(m.jobs, &memoryJob{
+		JobInfo: JobInfo{
+			ID:        id,
+			Lane:      lane,
+			Status:    StatusPending,
+			CreatedAt: now,
+			RunAt:     o.runAt,
+		},
+		row:       row,
+		priority:  o.priority,
+		uniqueKey: o.uniqueKey,
+	})
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// Process runs the jobs as they become due until the context is cancelled.
+// The clock is checked at every enqueue and heartbeat.
+func (m *MemoryQueue) Process(ctx context.Context, logger *log.Logger, run JobRunner) {
+	t := time.NewTicker(time.Duration(max(m.Queue.Heartbeat, timex.Duration(time.Millisecond))))
+	defer t.Stop()
+	for {
+		m.RunDue(ctx, logger, run)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// RunDue runs the jobs due at the current time of the clock, including the
+// ones enqueued by the runners, and returns the number of jobs run.
+func (m *MemoryQueue) RunDue(ctx context.Context, logger *log.Logger, run JobRunner) (n int) {
+	run = m.Queue.wrap(run)
+	for ctx.Err() == nil {
+		job, ok := m.claim()
+		if !ok {
+			break
+		}
+		m.execute(ctx, logger, run, job)
+		n++
+	}
+	return n
+}
+
+func (m *MemoryQueue) Job(ctx context.Context, id uuid.ID) (JobInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job, ok := m.find(id)
+	if !ok {
+		return JobInfo{}, errors.Wrap(ErrNoRows, `retrieving job`, `job_id`, id)
+	}
+	return job.JobInfo, nil
+}
+
+// Jobs returns the queue state of every job, in enqueue order.
+func (m *MemoryQueue) Jobs() []JobInfo {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	jobs := make([]JobInfo, len(m.jobs))
+	for i, job := range m.jobs {
+		jobs[i] = job.JobInfo
+	}
+	return jobs
+}
+
+// Result returns the result set by the runner of the job, if any.
+func (m *MemoryQueue) Result(id uuid.ID) json.RawMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job, ok := m.find(id)
+	if !ok {
+		return nil
+	}
+	return job.result
+}
+
+func (m *MemoryQueue) Cancel(ctx context.Context, id uuid.ID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job, ok := m.find(id)
+	if !ok {
+		return nil
+	}
+
+	switch job.Status {
+	case StatusPending:
+		job.Status = StatusCancelled
+		job.FinishedAt = NullTime{Time: m.Clock.Now(), Valid: true}
+	case StatusRunning:
+		job.Status = StatusCancelling
+		if job.cancel != nil {
+			job.cancel()
+		}
+	}
+	return nil
+}
+
+func (m *MemoryQueue) find(id uuid.ID) (*memoryJob, bool) {
+	for _, job := range m.jobs {
+		if job.ID == id {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// claim marks the next due job as running, following the order of the
+// lanes, then the priority and the enqueue order of the jobs.
+func (m *MemoryQueue) claim() (*memoryJob, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.Clock.Now()
+	for _, lane := range m.Queue.order(m.Queue.Lanes) {
+		var next *memoryJob
+		for _, job := range m.jobs {
+			if job.Lane != lane || job.Status != StatusPending || job.RunAt.After(now) {
+				continue
+			}
+			if next == nil || job.priority > next.priority {
+				next = job
+			}
+		}
+		if next == nil {
+			continue
+		}
+
+		next.Status = StatusRunning
+		next.Try++
+		next.StartedAt = NullTime{Time: now, Valid: true}
+		next.FinishedAt = NullTime{}
+		next.row["status"] = next.Status
+		next.row["try"] = next.Try
+		return next, true
+	}
+	return nil, false
+}
+
+// execute runs the job and records its outcome, as the Postgres processor
+// does.
+func (m *MemoryQueue) execute(ctx context.Context, logger *log.Logger, run JobRunner, job *memoryJob) {
+	logger = logger.With(`job_id`, job.ID)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.lock.Lock()
+	job.cancel = cancel
+	if job.Status == StatusCancelling {
+		cancel()
+	}
+	state := &jobState{job: Job{ID: job.ID, Try: job.Try, Status: job.Status, CreatedAt: job.CreatedAt}}
+	payload, err := json.Marshal(job.row)
+	metadata, _ := json.Marshal(job.row["metadata"])
+	lane, try := job.Lane, job.Try
+	m.lock.Unlock()
+
+	m.Queue.Hooks.claimed(ctx, state.job)
+	if err != nil {
+		err = errors.Wrap(err, `marshalling row`)
+	} else {
+		runCtx, metaErr := withJobMetadata(withJobState(jobCtx, state), metadata)
+		if metaErr != nil {
+			logger.Warn(`restoring job metadata`, `err`, metaErr)
+		}
+		m.Queue.Hooks.started(runCtx, state.job)
+		err = run(runCtx, logger, payload)
+	}
+	interrupted := jobCtx.Err() != nil
+	cancel()
+
+	m.lock.Lock()
+	job.cancel = nil
+
+	// The app is shutting down: put the job back without counting the try,
+	// unless it was cancelled by the user in the meantime.
+	if job.Status == StatusCancelling {
+		interrupted = true
+	} else if err != nil && ctx.Err() != nil {
+		logger.Info(`releasing job`)
+		job.Status = StatusPending
+		job.Try--
+		m.lock.Unlock()
+		m.Queue.Hooks.abandoned(context.WithoutCancel(ctx), state.job)
+		return
+	}
+
+	now := m.Clock.Now()
+	o := m.Queue.conclude(logger, lane, try, err, interrupted, false, now)
+	state.lock.Lock()
+	job.result = state.result
+	state.lock.Unlock()
+
+	job.Status = o.status
+	job.LastError = NullString{}
+	if err != nil {
+		job.LastError = NullString{String: err.Error(), Valid: true}
+	}
+	if o.status == StatusPending {
+		job.RunAt = o.runAt
+	} else {
+		job.FinishedAt = NullTime{Time: now, Valid: true}
+	}
+	m.lock.Unlock()
+
+	// The hooks are called without the lock, as they may use the queue.
+	m.Queue.Hooks.concluded(ctx, state.job, o)
+}
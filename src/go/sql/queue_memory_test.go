@@ -0,0 +1,112 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+	"ronce/src/go/timex"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	ctx := context.Background()
+	clock := timex.NewManualClock(time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC))
+	m := NewMemoryQueue(Queue{
+		Lanes: []string{"default"},
+		Retry: RetryPolicy{Attempts: 2, Delay: timex.Duration(time.Minute)},
+	}, clock)
+
+	type Payload struct {
+		Name string `json:"name"`
+	}
+	var tries int
+	run := Handle(func(ctx context.Context, logger *log.Logger, p Payload) error {
+		tries++
+		if p.Name == "flaky" && tries == 1 {
+			return errors.New("boom")
+		}
+		return SetResult(ctx, p.Name)
+	})
+
+	flaky, _ := m.Enqueue(ctx, "default", Payload{Name: "flaky"})
+	later, _ := m.Enqueue(ctx, "default", Payload{Name: "later"}, Delay(timex.Duration(time.Hour)))
+
+	if n := m.RunDue(ctx, log.New(), run); n != 1 {
+		t.Fatalf("RunDue: want 1 job run, got %d", n)
+	}
+	if job, _ := m.Job(ctx, flaky); job.Status != StatusPending || job.Try != 1 || !job.RunAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("failed job: want pending retry in 1m, got %+v", job)
+	}
+
+	clock.Advance(timex.Duration(time.Minute))
+	m.RunDue(ctx, log.New(), run)
+	if job, _ := m.Job(ctx, flaky); job.Status != StatusSucceeded || job.Try != 2 {
+		t.Fatalf("retried job: want succeeded at try 2, got %+v", job)
+	}
+	if got := string(m.Result(flaky)); got != `"flaky"` {
+		t.Errorf("Result: want %q, got %q", `"flaky"`, got)
+	}
+
+	if err := m.Cancel(ctx, later); err != nil {
+		t.Fatalf("Cancel: unexpected error %s", err)
+	}
+	clock.Advance(timex.Duration(time.Hour))
+	if n := m.RunDue(ctx, log.New(), run); n != 0 {
+		t.Errorf("RunDue: want cancelled job skipped, got %d jobs run", n)
+	}
+	if job, _ := m.Job(ctx, later); job.Status != StatusCancelled {
+		t.Errorf("cancelled job: want cancelled, got %s", job.Status)
+	}
+}
+
+func TestMemoryQueue_cancelRunning(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryQueue(Queue{Lanes: []string{"default"}}, timex.NewManualClock(time.Now()))
+
+	var status Status
+	run := func(ctx context.Context, logger *log.Logger, payload json.RawMessage) error {
+		job, _ := JobFromContext(ctx)
+		_ = m.Cancel(ctx, job.ID)
+		info, _ := m.Job(ctx, job.ID)
+		status = info.Status
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	id, _ := m.Enqueue(ctx, "default", nil)
+	m.RunDue(ctx, log.New(), run)
+	if status != StatusCancelling {
+		t.Errorf("running job: want cancelling, got %s", status)
+	}
+	if job, _ := m.Job(ctx, id); job.Status != StatusCancelled {
+		t.Errorf("cancelled job: want cancelled, got %s", job.Status)
+	}
+}
+
+func TestMemoryQueue_cancelDuringShutdown(t *testing.T) {
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	m := NewMemoryQueue(Queue{Lanes: []string{"default"}}, timex.NewManualClock(time.Now()))
+
+	var abandoned bool
+	m.Queue.Hooks.Abandoned = func(ctx context.Context, job Job) { abandoned = true }
+	run := func(ctx context.Context, logger *log.Logger, payload json.RawMessage) error {
+		job, _ := JobFromContext(ctx)
+		shutdown()
+		_ = m.Cancel(context.Background(), job.ID)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	id, _ := m.Enqueue(ctx, "default", nil)
+	m.RunDue(ctx, log.New(), run)
+	if job, _ := m.Job(context.Background(), id); job.Status != StatusCancelled || !job.FinishedAt.Valid {
+		t.Errorf("cancelled job: want cancelled, got %+v", job)
+	}
+	if abandoned {
+		t.Errorf("Abandoned: want hook not called for a cancelled job")
+	}
+}
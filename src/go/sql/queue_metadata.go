@@ -0,0 +1,60 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+)
+
+// jobMetadata is the context of the enqueuer of a job, stored in its metadata
+// column and restored in the context of the runner.
+type jobMetadata struct {
+	LogFields map[string]any `json:"log_fields,omitempty"`
+}
+
+// newJobMetadata captures the log fields of the context, so the logs of the
+// job can be correlated with the ones of the request that enqueued it.
+func newJobMetadata(ctx context.Context) jobMetadata {
+	var m jobMetadata
+	keyvals := log.ContextFields(ctx)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if m.LogFields == nil {
+			m.LogFields = make(map[string]any, len(keyvals)/2)
+		}
+		m.LogFields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	return m
+}
+
+// withJobMetadata restores the log fields of the metadata into the context,
+// after the ones already present.
+func withJobMetadata(ctx context.Context, raw json.RawMessage) (context.Context, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ctx, nil
+	}
+
+	var m jobMetadata
+	err := json.Unmarshal(raw, &m)
+	if err != nil {
+		return ctx, errors.Wrap(err, `unmarshalling job metadata`)
+	}
+	if len(m.LogFields) == 0 {
+		return ctx, nil
+	}
+
+	keys := make([]string, 0, len(m.LogFields))
+	for key := range m.LogFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	keyvals := append([]any(nil), log.ContextFields(ctx)...)
+	for _, key := range keys {
+		keyvals = append(keyvals, key, m.LogFields[key])
+	}
+	return log.AddContextFields(ctx, keyvals), nil
+}
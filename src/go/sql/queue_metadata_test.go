@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"ronce/src/go/log"
+	"ronce/src/go/timex"
+)
+
+func TestJobMetadata(t *testing.T) {
+	m := NewMemoryQueue(Queue{Lanes: []string{"default"}}, timex.NewManualClock(time.Now()))
+
+	request := log.AddContextFields(context.Background(), []any{"request_id", "abc", "user", "bob"})
+	if _, err := m.Enqueue(request, "default", nil); err != nil {
+		t.Fatalf("Enqueue: unexpected error %s", err)
+	}
+
+	var got []any
+	ctx := log.AddContextFields(context.Background(), []any{"app", "worker"})
+	m.RunDue(ctx, log.New(), func(ctx context.Context, logger *log.Logger, payload json.RawMessage) error {
+		got = log.ContextFields(ctx)
+		return nil
+	})
+
+	if want := []any{"app", "worker", "request_id", "abc", "user", "bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("runner log fields: want %v, got %v", want, got)
+	}
+}
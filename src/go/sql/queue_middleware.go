@@ -0,0 +1,88 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+)
+
+// Middleware wraps the runner of the jobs, to add a behaviour around every
+// job like tracing, metrics or log fields.
+type Middleware func(next JobRunner) JobRunner
+
+// Hooks are called at each step of the lifecycle of the jobs processed by a
+// queue, with the job in its new status. Nil hooks are skipped. They are
+// called by the worker running the job, so they must not block.
+type Hooks struct {
+	Claimed   func(ctx context.Context, job Job)
+	Started   func(ctx context.Context, job Job)
+	Succeeded func(ctx context.Context, job Job)
+	// Failed is called for every failed try, including the ones that are
+	// retried, timed out or ignored.
+	Failed    func(ctx context.Context, job Job, err error)
+	Cancelled func(ctx context.Context, job Job)
+	// Abandoned is called for the jobs released on shutdown.
+	Abandoned func(ctx context.Context, job Job)
+}
+
+// Chain wraps the runner with the middlewares, the first one being the
+// outermost.
+func Chain(run JobRunner, middlewares ...Middleware) JobRunner {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		run = middlewares[i](run)
+	}
+	return run
+}
+
+// wrap returns the runner wrapped with the middlewares of the queue. Panics
+// are recovered, including the ones of the middlewares, and fail the job
+// without retrying it as they are unlikely to go away.
+func (s Queue) wrap(run JobRunner) JobRunner {
+	run = Chain(run, s.Middlewares...)
+	return func(ctx context.Context, logger *log.Logger, payload json.RawMessage) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			err = Permanent(errors.New(`job panicked`, `panic`, fmt.Sprint(r), `stack`, string(debug.Stack())))
+		}()
+		return run(ctx, logger, payload)
+	}
+}
+
+func (h Hooks) claimed(ctx context.Context, job Job) {
+	if h.Claimed != nil {
+		h.Claimed(ctx, job)
+	}
+}
+
+func (h Hooks) started(ctx context.Context, job Job) {
+	if h.Started != nil {
+		h.Started(ctx, job)
+	}
+}
+
+func (h Hooks) abandoned(ctx context.Context, job Job) {
+	job.Status = StatusPending
+	if h.Abandoned != nil {
+		h.Abandoned(ctx, job)
+	}
+}
+
+// concluded calls the hook matching the outcome of the try.
+func (h Hooks) concluded(ctx context.Context, job Job, o outcome) {
+	job.Status = o.status
+	switch {
+	case o.status == StatusSucceeded && h.Succeeded != nil:
+		h.Succeeded(ctx, job)
+	case o.status == StatusCancelled && h.Cancelled != nil:
+		h.Cancelled(ctx, job)
+	case o.status != StatusSucceeded && o.status != StatusCancelled && h.Failed != nil:
+		h.Failed(ctx, job, o.err)
+	}
+}
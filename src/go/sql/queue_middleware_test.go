@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"ronce/src/go/log"
+	"ronce/src/go/timex"
+)
+
+func TestQueue_wrap(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next JobRunner) JobRunner {
+			return func(ctx context.Context, logger *log.Logger, payload json.RawMessage) error {
+				calls = append(calls, name)
+				return next(ctx, logger, payload)
+			}
+		}
+	}
+
+	var hooks []Status
+	record := func(ctx context.Context, job Job) { hooks = append(hooks, job.Status) }
+	m := NewMemoryQueue(Queue{
+		Lanes:       []string{"default"},
+		Middlewares: []Middleware{trace("outer"), trace("inner")},
+		Hooks: Hooks{
+			Claimed: record,
+			Started: record,
+			Failed:  func(ctx context.Context, job Job, err error) { record(ctx, job) },
+		},
+	}, timex.NewManualClock(time.Now()))
+
+	ctx := context.Background()
+	id, _ := m.Enqueue(ctx, "default", nil)
+	m.RunDue(ctx, log.New(), func(ctx context.Context, logger *log.Logger, payload json.RawMessage) error {
+		panic("boom")
+	})
+
+	if want := []string{"outer", "inner"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("middlewares: want calls %v, got %v", want, calls)
+	}
+	if want := []Status{StatusRunning, StatusRunning, StatusFailed}; !reflect.DeepEqual(hooks, want) {
+		t.Errorf("hooks: want statuses %v, got %v", want, hooks)
+	}
+	if job, _ := m.Job(ctx, id); job.Status != StatusFailed || job.LastError.String == "" {
+		t.Errorf("panicking job: want failed with an error, got %+v", job)
+	}
+}
@@ -0,0 +1,41 @@
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// notifyChannel returns the channel used to signal new jobs in the table.
+func notifyChannel(table string) string {
+	return "queue:" + table
+}
+
+// Notify wakes up the workers consuming the lane of the table. The inserted
+// jobs are notified by the trigger of the table, so it is only needed after
+// making existing jobs claimable again. When q is a transaction, the
+// notification is only delivered on commit.
+func Notify(ctx context.Context, q Queryer, table, lane string) error {
+	_, err := q.Exec(ctx, `select pg_notify(?, ?)`, notifyChannel(table), lane)
+	return err
+}
+
+// listen subscribes to the notifications of the table. If the subscription
+// fails, a nil channel is returned and the processor falls back to polling.
+func (p *processor) listen() (<-chan *pq.Notification, func()) {
+	listener := pq.NewListener(p.db.DSN, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			p.logger.Warn(`queue listener event`, `event`, event, `err`, err)
+		}
+	})
+
+	err := listener.Listen(notifyChannel(p.table))
+	if err != nil {
+		p.logger.Error(`listening for jobs, falling back to polling`, `err`, err)
+		_ = listener.Close()
+		return nil, func() {}
+	}
+
+	return listener.Notify, func() { _ = listener.Close() }
+}
@@ -0,0 +1,72 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ronce/src/go/errors"
+)
+
+func laneTable(table string) string {
+	return table + "_lanes"
+}
+
+// LanePause is a lane paused in a queue table.
+type LanePause struct {
+	Lane     string    `db:"lane"`
+	PausedAt time.Time `db:"paused_at"`
+	ResumeAt NullTime  `db:"resume_at"` // null if the lane is paused until resumed
+}
+
+// PauseLane stops the workers of every replica from claiming the jobs of the
+// lane, until ResumeLane is called or until resumeAt if it isn't zero. The
+// jobs already running finish normally. Pausing a paused lane updates its
+// resume time, while a lane whose pause expired is paused anew.
+func (s Queue) PauseLane(ctx context.Context, q Queryer, table, lane string, resumeAt time.Time) error {
+	resume := NullTime{Time: resumeAt, Valid: !resumeAt.IsZero()}
+	_, err := q.Exec(ctx, fmt.Sprintf(`
+		insert into %s as l (lane, paused_at, resume_at)
+		values (?, now(), ?)
+		on conflict (lane) do update
+		set paused_at = case
+		        when l.resume_at is not null and l.resume_at <= now() then excluded.paused_at
+		        else l.paused_at
+		    end,
+		    resume_at = excluded.resume_at
+	`, laneTable(table)), lane, resume)
+	return errors.Wrap(err, `pausing lane`, `table`, table, `lane`, lane)
+}
+
+// ResumeLane lets the workers claim the jobs of the lane again, and wakes
+// them up.
+func (s Queue) ResumeLane(ctx context.Context, q Queryer, table, lane string) error {
+	_, err := q.Exec(ctx, fmt.Sprintf(`delete from %s where lane = ?`, laneTable(table)), lane)
+	if err != nil {
+		return errors.Wrap(err, `resuming lane`, `table`, table, `lane`, lane)
+	}
+	return errors.Wrap(Notify(ctx, q, table, lane), `notifying workers`, `table`, table, `lane`, lane)
+}
+
+// PausedLanes returns the lanes of the table currently paused.
+func (s Queue) PausedLanes(ctx context.Context, q Queryer, table string) ([]LanePause, error) {
+	var lanes []LanePause
+	err := q.Select(ctx, &lanes, fmt.Sprintf(`
+		select lane, paused_at, resume_at
+		from %s
+		where resume_at is null or resume_at > now()
+		order by lane asc
+	`, laneTable(table)))
+	return lanes, errors.Wrap(err, `listing paused lanes`, `table`, table)
+}
+
+// paused returns the clause excluding the jobs of the paused lanes from the
+// claim.
+func (s Queue) paused(table string, now time.Time) (string, []any) {
+	return fmt.Sprintf(`not exists (
+		select 1
+		from %s l
+		where l.lane = j.lane
+		and (l.resume_at is null or l.resume_at > ?)
+	)`, laneTable(table)), []any{now}
+}
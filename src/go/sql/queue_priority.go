@@ -0,0 +1,108 @@
+package sql
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Lane scheduling modes, deciding in which order the lanes are looked at when
+// claiming a job.
+const (
+	// SchedulingStrict always looks at the lanes in their configured order,
+	// so a busy lane starves the lanes after it.
+	SchedulingStrict = "strict"
+	// SchedulingWeighted splits the jobs of each claim between the lanes in
+	// proportion to their weight, the rounding going to the lanes drawn
+	// first with a probability proportional to their weight. The shares
+	// left by the lanes short of jobs go to the other lanes, so each lane
+	// gets its share of the jobs under load without leaving workers idle.
+	SchedulingWeighted = "weighted"
+)
+
+// Priority sets the priority of the job within its lane: jobs with a higher
+// priority are claimed first. The default priority is 0.
+func Priority(priority int) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.priority = priority
+	}
+}
+
+// order returns the lanes in the order they should be looked at for the next
+// claim, according to the scheduling mode.
+func (s Queue) order(lanes []string) []string {
+	if s.Scheduling != SchedulingWeighted {
+		return lanes
+	}
+
+	// Weighted random sampling without replacement, see Efraimidis and
+	// Spirakis: sorting by u^(1/w) draws the first lane with a probability
+	// proportional to its weight, then the next among the remaining ones.
+	keys := make(map[string]float64, len(lanes))
+	for _, lane := range lanes {
+		keys[lane] = math.Pow(rand.Float64(), 1/float64(s.weight(lane)))
+	}
+
+	ordered := make([]string, len(lanes))
+	copy(ordered, lanes)
+	sort.Slice(ordered, func(i, j int) bool {
+		return keys[ordered[i]] > keys[ordered[j]]
+	})
+	return ordered
+}
+
+// weight returns the scheduling weight of the lane, 1 by default.
+func (s Queue) weight(lane string) int {
+	weight := s.LaneWeights.Get(lane, 1)
+	if weight <= 0 {
+		weight = 1
+	}
+	return weight
+}
+
+// shares returns the lanes in claim order, and the number of the n jobs of
+// the claim each lane can take within its room. In weighted mode, the jobs
+// are split between the lanes in proportion to their weight.
+func (s Queue) shares(lanes []string, room map[string]int, n int) ([]string, map[string]int) {
+	ordered := s.order(lanes)
+	shares := make(map[string]int, len(lanes))
+	if s.Scheduling != SchedulingWeighted {
+		for _, lane := range lanes {
+			shares[lane] = min(room[lane], n)
+		}
+		return ordered, shares
+	}
+
+	var total int
+	for _, lane := range lanes {
+		total += s.weight(lane)
+	}
+	left := n
+	for _, lane := range lanes {
+		shares[lane] = n * s.weight(lane) / total
+		left -= shares[lane]
+	}
+	for _, lane := range ordered[:left] {
+		shares[lane]++
+	}
+	for _, lane := range lanes {
+		shares[lane] = min(shares[lane], room[lane])
+	}
+	return ordered, shares
+}
+
+// refill returns the shares of a second claim of n jobs, after the first one
+// came back short: each lane can take up to the room it has left.
+func refill(lanes []string, room map[string]int, claimed []claimedJob, n int) map[string]int {
+	shares := make(map[string]int, len(lanes))
+	for _, lane := range lanes {
+		shares[lane] = room[lane]
+	}
+	for _, job := range claimed {
+		shares[job.Lane]--
+	}
+	for lane, share := range shares {
+		shares[lane] = max(min(share, n), 0)
+	}
+	return shares
+}
@@ -0,0 +1,75 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueue_order(t *testing.T) {
+	lanes := []string{"high", "low"}
+
+	strict := Queue{Scheduling: SchedulingStrict, LaneWeights: Keyed[int]{"high": 3}}
+	for i := 0; i < 100; i++ {
+		if got := strict.order(lanes); !reflect.DeepEqual(got, lanes) {
+			t.Fatalf("order in strict mode: want %v, got %v", lanes, got)
+		}
+	}
+
+	weighted := Queue{Scheduling: SchedulingWeighted, LaneWeights: Keyed[int]{"high": 3}}
+	var first int
+	const runs = 10000
+	for i := 0; i < runs; i++ {
+		got := weighted.order(lanes)
+		if len(got) != len(lanes) {
+			t.Fatalf("order in weighted mode: want %d lanes, got %v", len(lanes), got)
+		}
+		if got[0] == "high" {
+			first++
+		}
+	}
+
+	// With weights 3 and 1, the high lane should come first 75% of the time.
+	if share := float64(first) / runs; share < 0.72 || share > 0.78 {
+		t.Errorf("order in weighted mode: want high lane first ~75%% of the time, got %.2f", share)
+	}
+}
+
+func TestQueue_shares(t *testing.T) {
+	lanes := []string{"high", "low"}
+	room := map[string]int{"high": 10, "low": 2}
+
+	strict := Queue{Scheduling: SchedulingStrict}
+	if _, got := strict.shares(lanes, room, 6); !reflect.DeepEqual(got, map[string]int{"high": 6, "low": 2}) {
+		t.Errorf("shares in strict mode: got %v", got)
+	}
+
+	weighted := Queue{Scheduling: SchedulingWeighted, LaneWeights: Keyed[int]{"high": 3}}
+	if _, got := weighted.shares(lanes, room, 8); !reflect.DeepEqual(got, map[string]int{"high": 6, "low": 2}) {
+		t.Errorf("shares in weighted mode: got %v", got)
+	}
+	if _, got := weighted.shares(lanes, room, 1); got["high"]+got["low"] != 1 {
+		t.Errorf("shares in weighted mode: want 1 job in total, got %v", got)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	lanes := []string{"high", "low"}
+	room := map[string]int{"high": 1, "low": 1}
+
+	// With a single free slot, the weighted claim goes to one lane only. If
+	// it is empty, the refill must let the other lane take the job.
+	weighted := Queue{Scheduling: SchedulingWeighted}
+	ordered, shares := weighted.shares(lanes, room, 1)
+	if shares[ordered[0]] != 1 || shares[ordered[1]] != 0 {
+		t.Fatalf("shares of a single job: got %v for order %v", shares, ordered)
+	}
+	if got := refill(ordered, room, nil, 1); !reflect.DeepEqual(got, map[string]int{"high": 1, "low": 1}) {
+		t.Errorf("refill after an empty claim: got %v", got)
+	}
+
+	claimed := []claimedJob{{Lane: "high"}}
+	room = map[string]int{"high": 2, "low": 4}
+	if got := refill(lanes, room, claimed, 2); !reflect.DeepEqual(got, map[string]int{"high": 1, "low": 2}) {
+		t.Errorf("refill after a short claim: got %v", got)
+	}
+}
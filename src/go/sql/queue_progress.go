@@ -0,0 +1,92 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+
+	"ronce/src/go/errors"
+)
+
+// Progress is the handle used by a runner to report the progress of its job
+// and to checkpoint its work. The values are persisted with the next heartbeat
+// of the job, and the checkpoint is handed back on the next try if the job is
+// interrupted or fails.
+type Progress struct {
+	state *jobState
+}
+
+// ProgressFromContext returns the progress handle of the job running with the
+// context.
+func ProgressFromContext(ctx context.Context) (*Progress, bool) {
+	state, ok := jobStateFrom(ctx)
+	if !ok {
+		return nil, false
+	}
+	return &Progress{state}, true
+}
+
+// Report sets the completion of the job, between 0 and 1.
+func (p *Progress) Report(completion float64) {
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+	p.state.progress = &completion
+	p.state.dirty = true
+}
+
+// Checkpoint saves the JSON representation of v as the checkpoint of the job.
+// It should be kept small, as it is written with every heartbeat following a
+// change.
+func (p *Progress) Checkpoint(v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, `marshalling checkpoint`)
+	}
+
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+	p.state.checkpoint = raw
+	p.state.dirty = true
+	return nil
+}
+
+// Resume decodes the last checkpoint of the job into v, which is either the
+// one saved by the previous try or by the current one. It reports false if
+// there is no checkpoint.
+func (p *Progress) Resume(v any) (bool, error) {
+	p.state.lock.Lock()
+	raw := p.state.checkpoint
+	p.state.lock.Unlock()
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return false, nil
+	}
+	return true, errors.Wrap(json.Unmarshal(raw, v), `decoding checkpoint`)
+}
+
+// pending returns the progress and checkpoint changed since the last call, as
+// query arguments. The unchanged values are nil.
+func (s *jobState) pending() (progress, checkpoint any) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.dirty {
+		return nil, nil
+	}
+	s.dirty = false
+
+	if s.progress != nil {
+		progress = *s.progress
+	}
+	if s.checkpoint != nil {
+		checkpoint = string(s.checkpoint)
+	}
+	return progress, checkpoint
+}
+
+// retry marks the values as changed after a failed write, so they are written
+// with the next one.
+func (s *jobState) retry() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dirty = true
+}
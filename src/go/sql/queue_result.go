@@ -0,0 +1,186 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+)
+
+// jobState is the state of a running job shared with its runner through the
+// job context.
+type jobState struct {
+	job Job
+
+	lock       sync.Mutex
+	result     json.RawMessage
+	progress   *float64
+	checkpoint json.RawMessage
+	dirty      bool
+}
+
+type jobStateKey struct{}
+
+func withJobState(ctx context.Context, state *jobState) context.Context {
+	return context.WithValue(ctx, jobStateKey{}, state)
+}
+
+func jobStateFrom(ctx context.Context) (*jobState, bool) {
+	state, ok := ctx.Value(jobStateKey{}).(*jobState)
+	return state, ok
+}
+
+// SetResult stores the JSON representation of v as the result of the job
+// running with the context. The result is persisted alongside the final
+// status of the job.
+func SetResult(ctx context.Context, v any) error {
+	state, ok := jobStateFrom(ctx)
+	if !ok {
+		return errors.New(`setting job result: not in a job context`)
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, `marshalling job result`)
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.result = raw
+	return nil
+}
+
+// outcome is the result of an attempt at running a job.
+type outcome struct {
+	// status is the new status of the job, and attempt the status recorded
+	// in the history. They only differ when the job is retried.
+	status  Status
+	attempt Status
+	runAt   time.Time
+	err     error
+	result  json.RawMessage
+
+	// progress and checkpoint are the values reported since the last
+	// heartbeat, as query arguments.
+	progress   any
+	checkpoint any
+}
+
+// finish stores the outcome of the job attempt in the job row, and in the
+// attempts history table if enabled.
+func (p *processor) finish(ctx context.Context, logger *log.Logger, job claimedJob, o outcome) {
+	logger.Debug(`updating job status`, `status`, o.status)
+
+	if o.attempt == "" {
+		o.attempt = o.status
+	}
+
+	var runAt any
+	if !o.runAt.IsZero() {
+		runAt = o.runAt
+	}
+
+	var result any
+	if o.result != nil {
+		result = string(o.result)
+	}
+
+	var message, fields any
+	if o.err != nil {
+		message = o.err.Error()
+		fields = errorContext(o.err)
+	}
+
+	// A succeeded job is complete, and its checkpoint must not be used
+	// if it is ever retried manually.
+	progress, checkpoint := o.progress, o.checkpoint
+	complete := o.status == StatusSucceeded
+	if complete {
+		progress, checkpoint = 1.0, nil
+	}
+
+	// A retried job isn't finished yet, only its attempt is.
+	now := time.Now()
+	var finishedAt any
+	if o.status != StatusPending {
+		finishedAt = now
+	}
+
+	query := fmt.Sprintf(`
+		update %[1]s
+		set status = ?,
+		    run_at = coalesce(?, run_at),
+		    last_error = ?,
+		    error_context = ?::jsonb,
+		    finished_at = ?,
+		    result = coalesce(?::jsonb, result),
+		    progress = coalesce(?, progress),
+		    checkpoint = case when ? then null else coalesce(?::jsonb, checkpoint) end
+		where id = ?
+	`, p.table)
+	args := []any{o.status, runAt, message, fields, finishedAt, result, progress, complete, checkpoint, job.ID}
+
+	if p.History {
+		query = fmt.Sprintf(`
+			with job as (%[1]s returning id, try, started_at)
+			insert into %[2]s (job_id, try, status, error, error_context, started_at, finished_at)
+			select id, try, ?, ?, ?::jsonb, started_at, ?
+			from job
+		`, query, historyTable(p.table))
+		args = append(args, o.attempt, message, fields, now)
+	}
+
+	_, err := p.db.Exec(ctx, query, args...)
+	if err != nil {
+		logger.Error(`updating job status`, `err`, err)
+		return
+	}
+
+	if p.Dependencies && isUnsuccessful(o.status) {
+		err = cascadeDependencies(ctx, p.db, p.table, job.ID)
+		if err != nil {
+			logger.Error(`cascading job status`, `err`, err)
+		}
+	}
+}
+
+// historyTable returns the name of the table holding the attempts of the jobs
+// of the table.
+func historyTable(table string) string {
+	return table + "_attempts"
+}
+
+// errorContext returns the JSON representation of the contexts of the
+// errors.E found in the error chain, or nil if there is none. The innermost
+// context takes precedence.
+func errorContext(err error) any {
+	fields := make(map[string]any)
+	for err != nil {
+		var e errors.E
+		if !errors.As(err, &e) {
+			break
+		}
+		for k, v := range e.Context {
+			fields[k] = v
+		}
+		err = e.Err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		// Some values may not be marshallable, in which case we fall
+		// back to their default string representation.
+		for k, v := range fields {
+			fields[k] = fmt.Sprintf("%v", v)
+		}
+		raw, _ = json.Marshal(fields)
+	}
+	return string(raw)
+}
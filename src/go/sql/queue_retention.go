@@ -0,0 +1,112 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ronce/src/go/errors"
+)
+
+// archiveTable returns the name of the table receiving the expired jobs of
+// the table.
+func archiveTable(table string) string {
+	return table + "_archive"
+}
+
+// CreateArchiveTable creates the table receiving the expired jobs of the table
+// when Archive is set. It is idempotent and can be run at every startup.
+func CreateArchiveTable(ctx context.Context, q Queryer, table string) error {
+	_, err := q.Exec(ctx, fmt.Sprintf(`
+		create table if not exists %s (like %s including defaults)
+	`, archiveTable(table), table))
+	return errors.Wrap(err, `creating archive table`, `table`, table)
+}
+
+// checkRetention returns an error if the retention policy could remove jobs
+// that are not finished, or couldn't be applied.
+func (s Queue) checkRetention() error {
+	if len(s.Retention) == 0 {
+		return nil
+	}
+	for status := range s.Retention {
+		if Status(status) != StatusSucceeded && !isUnsuccessful(Status(status)) {
+			return errors.Newf(`invalid retention status %q: only finished jobs can expire`, status)
+		}
+	}
+	if s.RetentionInterval <= 0 {
+		return errors.New(`invalid retention interval: must be positive`, `retention_interval`, s.RetentionInterval)
+	}
+	if s.RetentionBatch <= 0 {
+		return errors.New(`invalid retention batch: must be positive`, `retention_batch`, s.RetentionBatch)
+	}
+	return nil
+}
+
+// maintain applies the retention policy at every RetentionInterval until the
+// context is cancelled.
+func (p *processor) maintain(ctx context.Context) {
+	t := time.NewTicker(time.Duration(p.RetentionInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for status, retention := range p.Retention {
+			err := p.expire(ctx, Status(status), time.Now().Add(-time.Duration(retention)))
+			if err != nil {
+				p.logger.Error(`expiring jobs`, `status`, status, `err`, err)
+			}
+		}
+	}
+}
+
+// expire removes the jobs with the status finished before the given time, by
+// batches of RetentionBatch rows so the table isn't locked for too long. The
+// removed jobs are moved to the archive table if Archive is set, otherwise
+// they are deleted. Either way, their attempts and dependencies are deleted.
+func (p *processor) expire(ctx context.Context, status Status, before time.Time) error {
+	for ctx.Err() == nil {
+		query := fmt.Sprintf(`
+			delete from %[1]s
+			where id in (
+				select id
+				from %[1]s
+				where status = ?
+				and coalesce(finished_at, created_at) < ?
+				limit ?
+				for update skip locked
+			)
+		`, p.table)
+		if p.Archive {
+			// Going through JSON makes the insert independent of the
+			// order of the columns in both tables.
+			query = fmt.Sprintf(`
+				with expired as (%[1]s returning *)
+				insert into %[2]s
+				select (jsonb_populate_record(null::%[2]s, to_jsonb(e.*))).*
+				from expired e
+			`, query, archiveTable(p.table))
+		}
+
+		res, err := p.db.Exec(ctx, query, status, before, p.RetentionBatch)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			p.logger.Debug(`expired jobs`, `status`, status, `count`, n)
+		}
+		if n < int64(p.RetentionBatch) {
+			return nil
+		}
+	}
+	return nil
+}
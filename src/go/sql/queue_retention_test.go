@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"testing"
+	"time"
+
+	"ronce/src/go/timex"
+)
+
+func TestQueue_checkRetention(t *testing.T) {
+	valid := Queue{
+		Retention:         Keyed[timex.Duration]{"succeeded": timex.Duration(time.Hour), "timed_out": timex.Duration(time.Hour)},
+		RetentionInterval: timex.Duration(time.Minute),
+		RetentionBatch:    1000,
+	}
+	if err := valid.checkRetention(); err != nil {
+		t.Errorf("checkRetention: unexpected error %s", err)
+	}
+
+	for name, update := range map[string]func(*Queue){
+		"live status": func(s *Queue) { s.Retention = Keyed[timex.Duration]{"pending": timex.Duration(time.Hour)} },
+		"typo":        func(s *Queue) { s.Retention = Keyed[timex.Duration]{"succeded": timex.Duration(time.Hour)} },
+		"interval":    func(s *Queue) { s.RetentionInterval = 0 },
+		"batch":       func(s *Queue) { s.RetentionBatch = 0 },
+	} {
+		s := valid
+		update(&s)
+		if err := s.checkRetention(); err == nil {
+			t.Errorf("checkRetention with invalid %s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package sql
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/timex"
+)
+
+// RetryPolicy defines how many times a failing job is attempted, and how long
+// to wait between the attempts. The delay doubles at each attempt, up to
+// MaxDelay, and a random duration up to Jitter is added to spread the retries
+// of jobs failing together.
+type RetryPolicy struct {
+	Attempts int            `key:"attempts"  default:"1"  description:"maximum number of attempts for a failing job"`
+	Delay    timex.Duration `key:"delay"     default:"1s" description:"delay before the first retry"`
+	Jitter   timex.Duration `key:"jitter"    default:"0s" description:"maximum random delay added to each retry"`
+	MaxDelay timex.Duration `key:"max-delay" default:"1h" description:"maximum delay between two retries"`
+}
+
+// Backoff returns the delay to wait after the given failed try, starting at 1.
+// A zero MaxDelay doesn't cap the delay.
+func (r RetryPolicy) Backoff(try int) time.Duration {
+	limit := time.Duration(r.MaxDelay)
+	if limit <= 0 {
+		limit = math.MaxInt64 / 2
+	}
+
+	delay := time.Duration(r.Delay)
+	for i := 1; i < try && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if r.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(r.Jitter)))
+	}
+	return delay
+}
+
+// UnmarshalText parses the compact form of the policy used in the per-lane
+// configuration: attempts/delay/jitter/max-delay, like 5/1s/500ms/10m.
+func (r *RetryPolicy) UnmarshalText(raw []byte) (err error) {
+	chunks := strings.Split(string(raw), "/")
+	if len(chunks) != 4 {
+		return errors.Newf(`invalid retry policy %q: expected attempts/delay/jitter/max-delay`, raw)
+	}
+
+	r.Attempts, err = strconv.Atoi(chunks[0])
+	if err != nil {
+		return errors.Wrap(err, `parsing attempts`)
+	}
+	for i, d := range []*timex.Duration{&r.Delay, &r.Jitter, &r.MaxDelay} {
+		err = d.UnmarshalText([]byte(chunks[i+1]))
+		if err != nil {
+			return errors.Wrapf(err, `parsing segment %d`, i+2)
+		}
+	}
+	return nil
+}
+
+func (r RetryPolicy) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf(`%d/%s/%s/%s`, r.Attempts, r.Delay, r.Jitter, r.MaxDelay)), nil
+}
+
+// retryPolicy returns the policy applied to the jobs of the lane.
+func (s Queue) retryPolicy(lane string) RetryPolicy {
+	return s.LaneRetry.Get(lane, s.Retry)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks the error as permanent: a job failing with it is marked
+// failed without consuming the remaining attempts of the retry policy.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// IsPermanent reports whether the error was marked with Permanent.
+func IsPermanent(err error) bool {
+	var e permanentError
+	return errors.As(err, &e)
+}
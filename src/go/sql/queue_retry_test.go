@@ -0,0 +1,67 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"ronce/src/go/timex"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, Delay: timex.Second, MaxDelay: 10 * timex.Second}
+	for try, want := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		if got := policy.Backoff(try); got != want {
+			t.Errorf("Backoff(%d): want %s, got %s", try, want, got)
+		}
+	}
+
+	policy.Jitter = 500 * timex.Millisecond
+	for i := 0; i < 100; i++ {
+		got := policy.Backoff(1)
+		if got < time.Second || got >= 1500*time.Millisecond {
+			t.Errorf("Backoff(1) with jitter: got %s out of [1s,1.5s)", got)
+		}
+	}
+}
+
+func TestRetryPolicy_UnmarshalText(t *testing.T) {
+	var got RetryPolicy
+	if err := got.UnmarshalText([]byte(`5/1s/500ms/10m`)); err != nil {
+		t.Fatal(err)
+	}
+	want := RetryPolicy{Attempts: 5, Delay: timex.Second, Jitter: 500 * timex.Millisecond, MaxDelay: 10 * timex.Minute}
+	if got != want {
+		t.Errorf("UnmarshalText: want %v, got %v", want, got)
+	}
+
+	for _, input := range []string{`5`, `five/1s/0s/1m`, `5/1s/0s`} {
+		if err := got.UnmarshalText([]byte(input)); err == nil {
+			t.Errorf("UnmarshalText(%q): expected an error", input)
+		}
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	err := errors.New("boom")
+	if IsPermanent(err) {
+		t.Errorf("IsPermanent(%v): want false", err)
+	}
+	if !IsPermanent(Permanent(err)) {
+		t.Errorf("IsPermanent(Permanent(%v)): want true", err)
+	}
+	if wrapped := fmt.Errorf("wrapped: %w", Permanent(err)); !IsPermanent(wrapped) {
+		t.Errorf("IsPermanent(%v): want true", wrapped)
+	}
+	if Permanent(nil) != nil {
+		t.Errorf("Permanent(nil): want nil")
+	}
+}
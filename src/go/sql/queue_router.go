@@ -0,0 +1,111 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+	"ronce/src/go/uuid"
+)
+
+// CreateJobTable creates a generic job table, or upgrades it. On top of the
+// queue columns created by CreateQueueTable, the jobs of a generic table carry
+// their kind in the type column and their data in the payload column, so a
+// single table and worker can serve many kinds of jobs through a Router.
+func CreateJobTable(ctx context.Context, q Queryer, table string) error {
+	err := CreateQueueTable(ctx, q, table)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf(`alter table %s add column if not exists type text not null default ''`, table),
+		fmt.Sprintf(`alter table %s add column if not exists payload jsonb not null default '{}'`, table),
+	} {
+		_, err = q.Exec(ctx, query)
+		if err != nil {
+			return errors.Wrap(err, `creating job table`, `table`, table)
+		}
+	}
+	return nil
+}
+
+// EnqueueType inserts a job of the given type in a generic job table, see
+// CreateJobTable. The payload is stored as JSON in the payload column.
+func (s Queue) EnqueueType(ctx context.Context, q Queryer, table, lane, jobType string, payload any, opts ...EnqueueOption) (uuid.ID, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return uuid.ID{}, errors.Wrap(err, `marshalling payload`, `type`, jobType)
+	}
+
+	return s.Enqueue(ctx, q, table, lane, map[string]any{
+		"type":    jobType,
+		"payload": json.RawMessage(raw),
+	}, opts...)
+}
+
+// Router dispatches the jobs of a generic job table to the handler registered
+// for their type. Its Run method is the JobRunner to give to Queue.Process.
+type Router struct {
+	handlers map[string]JobRunner
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]JobRunner)}
+}
+
+// Route registers the handler of the jobs of the given type, their payload
+// being decoded into T as done by Handle. Registering a type twice replaces
+// the previous handler.
+func Route[T any](r *Router, jobType string, fn func(context.Context, *log.Logger, T) error) {
+	r.handlers[jobType] = Handle(fn)
+}
+
+// Run dispatches the job to the handler of its type. Jobs with an unknown type
+// are ignored.
+func (r *Router) Run(ctx context.Context, logger *log.Logger, row json.RawMessage) error {
+	var job struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	err := json.Unmarshal(row, &job)
+	if err != nil {
+		return Permanent(errors.Wrap(err, `decoding job`))
+	}
+
+	handler, ok := r.handlers[job.Type]
+	if !ok {
+		return Ignore(errors.New(`unknown job type`, `type`, job.Type))
+	}
+
+	return handler(ctx, logger.With(`job_type`, job.Type), job.Payload)
+}
+
+type ignoredError struct {
+	err error
+}
+
+func (e ignoredError) Error() string {
+	return e.err.Error()
+}
+
+func (e ignoredError) Unwrap() error {
+	return e.err
+}
+
+// Ignore marks the error as a reason to ignore the job: the job is marked
+// ignored instead of failed, and isn't retried.
+func Ignore(err error) error {
+	if err == nil {
+		return nil
+	}
+	return ignoredError{err}
+}
+
+// IsIgnored reports whether the error was marked with Ignore.
+func IsIgnored(err error) bool {
+	var e ignoredError
+	return errors.As(err, &e)
+}
@@ -0,0 +1,35 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"ronce/src/go/log"
+)
+
+func TestRouter_Run(t *testing.T) {
+	type Email struct {
+		To string `json:"to"`
+	}
+
+	var got Email
+	r := NewRouter()
+	Route(r, "email", func(ctx context.Context, logger *log.Logger, e Email) error {
+		got = e
+		return nil
+	})
+
+	row := json.RawMessage(`{"id": "017f1bb5dd6ae6f7b3489d110fc6c286", "type": "email", "payload": {"to": "doc@example.com"}}`)
+	if err := r.Run(context.Background(), log.New(), row); err != nil {
+		t.Fatalf("Run: unexpected error %s", err)
+	}
+	if got.To != "doc@example.com" {
+		t.Errorf("Run: want payload decoded into the handler type, got %v", got)
+	}
+
+	row = json.RawMessage(`{"type": "sms", "payload": {}}`)
+	if err := r.Run(context.Background(), log.New(), row); !IsIgnored(err) {
+		t.Errorf("Run: want an ignored error for an unknown type, got %v", err)
+	}
+}
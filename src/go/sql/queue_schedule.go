@@ -0,0 +1,195 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+	"ronce/src/go/timex"
+)
+
+// CatchUp defines what a Scheduler does with the ticks missed while no
+// replica was running.
+type CatchUp string
+
+const (
+	// CatchUpSkip drops the ticks due since more than twice the check
+	// interval of the scheduler.
+	CatchUpSkip CatchUp = "skip"
+	// CatchUpLatest enqueues a single job for all the missed ticks.
+	CatchUpLatest CatchUp = "latest"
+	// CatchUpAll enqueues a job for every missed tick, up to
+	// maxCatchUpTicks.
+	CatchUpAll CatchUp = "all"
+)
+
+// maxCatchUpTicks bounds the number of jobs enqueued at once by CatchUpAll, so
+// a long outage of a frequent schedule doesn't flood the queue.
+const maxCatchUpTicks = 100
+
+// Schedule describes a periodic job. Exactly one of Cron and Every must be
+// set.
+type Schedule struct {
+	Name    string         // unique name, used for coordinating the replicas
+	Lane    string         // lane the jobs are enqueued into
+	Cron    timex.Cron     // cron expression of the ticks, evaluated in UTC
+	Every   timex.Duration // interval between two ticks
+	Payload any            // payload of the enqueued jobs, see Queue.Enqueue
+	CatchUp CatchUp        // policy for the missed ticks, CatchUpLatest if empty
+}
+
+// next returns the first tick strictly after t.
+func (s Schedule) next(t time.Time) time.Time {
+	if !s.Cron.IsZero() {
+		return s.Cron.Next(t.UTC())
+	}
+	return t.Add(time.Duration(s.Every))
+}
+
+// Scheduler enqueues the jobs of the schedules into the table at each of
+// their ticks. Every replica can run a Scheduler: they coordinate through
+// the queue_schedules table so each tick is enqueued exactly once.
+type Scheduler struct {
+	Queue     Queue
+	Table     string         // queue table receiving the jobs
+	Interval  timex.Duration // interval between two checks of the schedules
+	Schedules []Schedule
+}
+
+// CreateScheduleTable creates the table storing the next tick of each
+// schedule. It is idempotent and can be run at every startup.
+func CreateScheduleTable(ctx context.Context, q Queryer) error {
+	_, err := q.Exec(ctx, `
+		create table if not exists queue_schedules (
+			name text primary key,
+			next_at timestamptz not null
+		)
+	`)
+	return errors.Wrap(err, `creating schedule table`)
+}
+
+// Run checks the schedules at every interval until the context is cancelled.
+func (s Scheduler) Run(ctx context.Context, logger *log.Logger, db *DB) {
+	if s.Interval <= 0 {
+		logger.Error(`invalid scheduler: interval must be positive`, `interval`, s.Interval)
+		return
+	}
+	for _, schedule := range s.Schedules {
+		if schedule.Cron.IsZero() == (schedule.Every <= 0) {
+			logger.Error(`invalid schedule: exactly one of cron and every must be set`, `schedule`, schedule.Name)
+			return
+		}
+		// Valid cron expressions can still never match, like February 30.
+		if schedule.next(time.Now()).IsZero() {
+			logger.Error(`invalid schedule: no upcoming tick`, `schedule`, schedule.Name, `cron`, schedule.Cron)
+			return
+		}
+	}
+
+	t := time.NewTicker(time.Duration(s.Interval))
+	defer t.Stop()
+	for {
+		for _, schedule := range s.Schedules {
+			err := s.tick(ctx, db, schedule)
+			if err != nil {
+				logger.Error(`running schedule`, `schedule`, schedule.Name, `err`, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// tick enqueues the jobs of the schedule that are due. The schedule row is
+// locked for the duration of the transaction so only one replica enqueues the
+// jobs of a tick, the others skipping the schedule.
+func (s Scheduler) tick(ctx context.Context, db *DB, schedule Schedule) error {
+	now := time.Now()
+
+	_, err := db.Exec(ctx, `
+		insert into queue_schedules (name, next_at)
+		values (?, ?)
+		on conflict do nothing
+	`, schedule.Name, schedule.next(now))
+	if err != nil {
+		return errors.Wrap(err, `initializing schedule`)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return errors.Wrap(err, `starting transaction`)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var next time.Time
+	err = tx.Get(ctx, &next, `
+		select next_at
+		from queue_schedules
+		where name = ?
+		for update skip locked
+	`, schedule.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, `locking schedule`)
+	}
+	if next.After(now) {
+		return nil
+	}
+
+	var ticks []time.Time
+	for ; !next.IsZero() && !next.After(now); next = schedule.next(next) {
+		ticks = append(ticks, next)
+	}
+	if len(ticks) == 0 {
+		return errors.New(`schedule has no next tick`)
+	}
+
+	switch schedule.CatchUp {
+	case CatchUpSkip:
+		var kept []time.Time
+		for _, tick := range ticks {
+			if now.Sub(tick) < 2*time.Duration(s.Interval) {
+				kept = append(kept, tick)
+			}
+		}
+		ticks = kept
+		if len(ticks) > 1 {
+			ticks = ticks[len(ticks)-1:]
+		}
+	case CatchUpAll:
+		if len(ticks) > maxCatchUpTicks {
+			ticks = ticks[len(ticks)-maxCatchUpTicks:]
+		}
+	default:
+		ticks = ticks[len(ticks)-1:]
+	}
+
+	for _, tick := range ticks {
+		_, err = s.Queue.Enqueue(ctx, tx, s.Table, schedule.Lane, schedule.Payload, RunAt(tick))
+		if err != nil {
+			return errors.Wrap(err, `enqueuing job`, `tick`, tick)
+		}
+	}
+
+	if next.IsZero() {
+		return errors.New(`schedule has no next tick`)
+	}
+	_, err = tx.Exec(ctx, `
+		update queue_schedules
+		set next_at = ?
+		where name = ?
+	`, next, schedule.Name)
+	if err != nil {
+		return errors.Wrap(err, `updating schedule`)
+	}
+
+	return errors.Wrap(tx.Commit(), `committing schedule`)
+}
@@ -0,0 +1,235 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"ronce/src/go/errors"
+)
+
+// queueColumns are the columns required on every queue table, with the
+// definition used when adding them.
+var queueColumns = []struct {
+	name       string
+	definition string
+}{
+	{"id", "uuid not null"},
+	{"lane", "text not null default ''"},
+	{"status", "queue_status not null default 'pending'"},
+	{"try", "int not null default 0"},
+	{"run_at", "timestamptz not null default now()"},
+	{"heartbeat_at", "timestamptz"},
+	{"created_at", "timestamptz not null default now()"},
+	{"started_at", "timestamptz"},
+	{"finished_at", "timestamptz"},
+	{"last_error", "text"},
+	{"error_context", "jsonb"},
+	{"result", "jsonb"},
+	{"unique_key", "text"},
+	{"progress", "real"},
+	{"checkpoint", "jsonb"},
+	{"priority", "int not null default 0"},
+	{"max_runtime", "double precision"},
+	{"metadata", "jsonb"},
+}
+
+// statuses lists every job status, in the order of the queue_status enum.
+var statuses = []Status{
+	StatusPending,
+	StatusRunning,
+	StatusSucceeded,
+	StatusFailed,
+	StatusCancelling,
+	StatusCancelled,
+	StatusIgnored,
+	StatusTimedOut,
+}
+
+// CreateQueueTable creates the queue table, or upgrades it by adding the
+// missing queue columns. It also creates the queue_status enum, the partial
+// indexes used for claiming pending and timed out running jobs and for
+// deduplicating jobs on their unique key, the index used by the retention
+// policy, the trigger notifying the workers on inserts, and the attempts
+// history, dependencies and paused lanes tables. It is idempotent and can be
+// run at every startup.
+func CreateQueueTable(ctx context.Context, q Queryer, table string) error {
+	values := make([]string, len(statuses))
+	for i, status := range statuses {
+		values[i] = fmt.Sprintf("'%s'", status)
+	}
+
+	var queries = []string{
+		fmt.Sprintf(`
+			do $$
+			begin
+				create type queue_status as enum (%s);
+			exception
+				when duplicate_object then null;
+			end
+			$$
+		`, strings.Join(values, ", ")),
+		fmt.Sprintf(`create table if not exists %s (id uuid primary key)`, table),
+	}
+
+	// Statuses added after the creation of the enum.
+	for _, value := range values {
+		queries = append(queries, fmt.Sprintf(`alter type queue_status add value if not exists %s`, value))
+	}
+
+	for _, column := range queueColumns {
+		queries = append(queries, fmt.Sprintf(`alter table %s add column if not exists %s %s`, table, column.name, column.definition))
+	}
+
+	queries = append(queries,
+		fmt.Sprintf(`create index if not exists %s on %s (lane, run_at) where status = 'pending'`, indexName(table, "pending"), table),
+		fmt.Sprintf(`create index if not exists %s on %s (lane, heartbeat_at) where status = 'running'`, indexName(table, "running"), table),
+		fmt.Sprintf(`create unique index if not exists %s on %s (unique_key) where status in ('pending', 'running', 'cancelling')`, indexName(table, "unique"), table),
+		fmt.Sprintf(`create index if not exists %s on %s (unique_key, finished_at) where unique_key is not null`, indexName(table, "unique_finished"), table),
+		fmt.Sprintf(`create index if not exists %s on %s (status, finished_at) where status not in ('pending', 'running', 'cancelling')`, indexName(table, "finished"), table),
+		`
+			create or replace function queue_notify() returns trigger as $$
+			begin
+				perform pg_notify(tg_argv[0], new.lane);
+				return new;
+			end
+			$$ language plpgsql
+		`,
+		fmt.Sprintf(`drop trigger if exists %s on %s`, indexName(table, "notify"), table),
+		fmt.Sprintf(`
+			create trigger %s
+			after insert on %s
+			for each row
+			execute function queue_notify('%s')
+		`, indexName(table, "notify"), table, notifyChannel(table)),
+		fmt.Sprintf(`
+			create table if not exists %[1]s (
+				job_id uuid not null references %[2]s (id) on delete cascade,
+				try int not null,
+				status queue_status not null,
+				error text,
+				error_context jsonb,
+				started_at timestamptz,
+				finished_at timestamptz not null
+			)
+		`, historyTable(table), table),
+		fmt.Sprintf(`create index if not exists %s on %s (job_id, try)`, indexName(historyTable(table), "job"), historyTable(table)),
+		fmt.Sprintf(`
+			create table if not exists %[1]s (
+				job_id uuid not null references %[2]s (id) on delete cascade,
+				parent_id uuid not null references %[2]s (id) on delete cascade,
+				policy text not null,
+				primary key (job_id, parent_id)
+			)
+		`, dependencyTable(table), table),
+		fmt.Sprintf(`create index if not exists %s on %s (parent_id)`, indexName(dependencyTable(table), "parent"), dependencyTable(table)),
+		fmt.Sprintf(`
+			create table if not exists %s (
+				lane text primary key,
+				paused_at timestamptz not null default now(),
+				resume_at timestamptz
+			)
+		`, laneTable(table)),
+	)
+
+	for _, query := range queries {
+		_, err := q.Exec(ctx, query)
+		if err != nil {
+			return errors.Wrap(err, `creating queue table`, `table`, table, `query`, strings.Join(strings.Fields(query), " "))
+		}
+	}
+	return nil
+}
+
+// indexName returns the name of an object attached to the table. The schema
+// is stripped, as indexes and triggers live in the schema of their table.
+func indexName(table, suffix string) string {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		table = table[i+1:]
+	}
+	return table + "_" + suffix
+}
+
+// CheckQueueTable returns an error if the table doesn't exist or is missing
+// any of the queue columns.
+func CheckQueueTable(ctx context.Context, q Queryer, table string) error {
+	var exists bool
+	err := q.Get(ctx, &exists, `select to_regclass(?) is not null`, table)
+	if err != nil {
+		return errors.Wrap(err, `checking queue table`, `table`, table)
+	}
+	if !exists {
+		return errors.Newf(`queue table %s does not exist`, table)
+	}
+
+	var columns []string
+	err = q.Select(ctx, &columns, `
+		select attname
+		from pg_attribute
+		where attrelid = to_regclass(?)
+		and attnum > 0
+		and not attisdropped
+	`, table)
+	if err != nil {
+		return errors.Wrap(err, `listing queue table columns`, `table`, table)
+	}
+
+	present := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		present[column] = true
+	}
+
+	var missing []string
+	for _, column := range queueColumns {
+		if !present[column.name] {
+			missing = append(missing, column.name)
+		}
+	}
+	if len(missing) != 0 {
+		return errors.Newf(`queue table %s is missing columns: %s`, table, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Check verifies that the tables are usable by the queue, including their
+// attempts history, dependencies and paused lanes tables if enabled, and that
+// the retention policy only applies to finished jobs. It is meant to be called
+// at startup so a misconfigured queue fails early.
+func (s Queue) Check(ctx context.Context, q Queryer, tables ...string) error {
+	err := s.checkRetention()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		err = CheckQueueTable(ctx, q, table)
+		if err != nil {
+			return err
+		}
+
+		var extra []string
+		if s.History {
+			extra = append(extra, historyTable(table))
+		}
+		if s.Dependencies {
+			extra = append(extra, dependencyTable(table))
+		}
+		if s.Pausing {
+			extra = append(extra, laneTable(table))
+		}
+		if s.Archive && len(s.Retention) != 0 {
+			extra = append(extra, archiveTable(table))
+		}
+		for _, name := range extra {
+			var exists bool
+			err = q.Get(ctx, &exists, `select to_regclass(?) is not null`, name)
+			if err != nil {
+				return errors.Wrap(err, `checking queue table`, `table`, name)
+			}
+			if !exists {
+				return errors.Newf(`queue table %s does not exist`, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/timex"
+)
+
+// LaneStats are the statistics of the jobs of a lane with a given status. The
+// flat shape makes them easy to export as metrics labelled by lane and status.
+type LaneStats struct {
+	Lane   string
+	Status Status
+	Count  int64
+
+	// OldestPending is the time the oldest claimable job has been waiting
+	// since its run_at. It is only set for the pending status.
+	OldestPending timex.Duration
+
+	// P50 and P95 are the run durations of the jobs that finished with the
+	// status during the stats window, and Throughput their number per second.
+	P50        timex.Duration
+	P95        timex.Duration
+	Throughput float64
+}
+
+// Stats returns the statistics of the jobs of the table, per lane and per
+// status. The durations and throughput are computed over the StatsWindow.
+func (s Queue) Stats(ctx context.Context, db *DB, table string) ([]LaneStats, error) {
+	now := time.Now()
+	since := now.Add(-time.Duration(s.StatsWindow))
+
+	var rows []struct {
+		Lane     string  `db:"lane"`
+		Status   Status  `db:"status"`
+		Count    int64   `db:"count"`
+		Oldest   float64 `db:"oldest"`
+		P50      float64 `db:"p50"`
+		P95      float64 `db:"p95"`
+		Finished int64   `db:"finished"`
+	}
+	query, args, err := In(fmt.Sprintf(`
+		select
+			lane,
+			status,
+			count(*) as count,
+			coalesce(extract(epoch from ? - min(run_at) filter (where status = ? and run_at <= ?)), 0) as oldest,
+			coalesce(percentile_cont(0.5) within group (order by extract(epoch from finished_at - started_at)) filter (where status not in (?) and finished_at > ?), 0) as p50,
+			coalesce(percentile_cont(0.95) within group (order by extract(epoch from finished_at - started_at)) filter (where status not in (?) and finished_at > ?), 0) as p95,
+			count(*) filter (where status not in (?) and finished_at > ?) as finished
+		from %s
+		group by lane, status
+		order by lane, status
+	`, table),
+		now, StatusPending, now,
+		activeStatuses, since,
+		activeStatuses, since,
+		activeStatuses, since,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, `building stats query`)
+	}
+
+	err = db.Select(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, `computing queue stats`, `table`, table)
+	}
+
+	stats := make([]LaneStats, len(rows))
+	for i, row := range rows {
+		stats[i] = LaneStats{
+			Lane:          row.Lane,
+			Status:        row.Status,
+			Count:         row.Count,
+			OldestPending: seconds(row.Oldest),
+			P50:           seconds(row.P50),
+			P95:           seconds(row.P95),
+		}
+		if s.StatsWindow > 0 {
+			stats[i].Throughput = float64(row.Finished) / s.StatsWindow.Seconds()
+		}
+	}
+	return stats, nil
+}
+
+func seconds(s float64) timex.Duration {
+	return timex.Duration(s * float64(time.Second))
+}
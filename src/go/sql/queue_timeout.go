@@ -0,0 +1,30 @@
+package sql
+
+import (
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/timex"
+)
+
+// errMaxRuntime is the cause of the cancellation of the jobs running for
+// longer than their maximum runtime.
+var errMaxRuntime = errors.New(`maximum runtime exceeded`)
+
+// MaxRuntime bounds the time the job can run, overriding the maximum runtime
+// of its lane. Once exceeded, the job context is cancelled and the attempt is
+// recorded as timed out.
+func MaxRuntime(d timex.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.maxRuntime = d
+	}
+}
+
+// maxRuntime returns the maximum runtime of the job, or 0 if it can run
+// indefinitely.
+func (s Queue) maxRuntime(job claimedJob) time.Duration {
+	if job.MaxRuntime != nil {
+		return time.Duration(*job.MaxRuntime * float64(time.Second))
+	}
+	return time.Duration(s.LaneMaxRuntime.Get(job.Lane, s.MaxRuntime))
+}
@@ -0,0 +1,30 @@
+package sql
+
+import (
+	"testing"
+	"time"
+
+	"ronce/src/go/timex"
+)
+
+func TestQueue_maxRuntime(t *testing.T) {
+	s := Queue{
+		MaxRuntime:     timex.Duration(time.Minute),
+		LaneMaxRuntime: Keyed[timex.Duration]{"slow": timex.Duration(time.Hour)},
+	}
+	custom := 1.5
+
+	type Case struct {
+		job  claimedJob
+		want time.Duration
+	}
+	for _, c := range []Case{
+		{claimedJob{Lane: "fast"}, time.Minute},
+		{claimedJob{Lane: "slow"}, time.Hour},
+		{claimedJob{Lane: "slow", MaxRuntime: &custom}, 1500 * time.Millisecond},
+	} {
+		if got := s.maxRuntime(c.job); got != c.want {
+			t.Errorf("maxRuntime(%s): want %s, got %s", c.job.Lane, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ronce/src/go/errors"
+	"ronce/src/go/timex"
+	"ronce/src/go/uuid"
+
+	"github.com/lib/pq"
+)
+
+// activeStatuses are the statuses of the jobs that are not finished yet.
+var activeStatuses = []Status{StatusPending, StatusRunning, StatusCancelling}
+
+// Unique deduplicates the job on the key: enqueuing a job whose key matches a
+// job that is not finished yet is a no-op returning the id of the existing
+// job. If window is positive, the jobs finished since less than window, with
+// any status, count as well.
+func Unique(key string, window timex.Duration) EnqueueOption {
+	return func(o *enqueueOptions) {
+		o.uniqueKey = key
+		o.uniqueWindow = window
+	}
+}
+
+// findUnique returns the id of the job with the key, either not finished or
+// finished since less than window.
+func findUnique(ctx context.Context, q Queryer, table, key string, window timex.Duration) (id uuid.ID, found bool, err error) {
+	query, args, err := In(fmt.Sprintf(`
+		select id
+		from %s
+		where unique_key = ?
+		and (status in (?) or finished_at > ?)
+		order by created_at desc
+		limit 1
+	`, table), key, activeStatuses, time.Now().Add(-time.Duration(window)))
+	if err != nil {
+		return id, false, err
+	}
+
+	err = q.Get(ctx, &id, query, args...)
+	if errors.Is(err, ErrNoRows) {
+		return id, false, nil
+	}
+	return id, err == nil, err
+}
+
+// insertUnique runs the insert, and reports whether it failed because of a
+// job with the same unique key. When q is a transaction, the insert runs in a
+// savepoint so the transaction stays usable after a duplicate.
+func insertUnique(ctx context.Context, q Queryer, insert func() error) (duplicate bool, err error) {
+	_, inTx := q.(*Tx)
+	if inTx {
+		_, err = q.Exec(ctx, `savepoint queue_enqueue`)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = insert()
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == CodeDuplicateKeyValue {
+		key, _, parseErr := ParseForeignKeyViolationDetail(pqErr)
+		duplicate = parseErr == nil && key == "unique_key"
+	}
+
+	if inTx {
+		statement := `release savepoint queue_enqueue`
+		if err != nil {
+			statement = `rollback to savepoint queue_enqueue`
+		}
+		_, spErr := q.Exec(ctx, statement)
+		if spErr != nil && err == nil {
+			err = spErr
+		}
+	}
+
+	if duplicate {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,180 @@
+package timex
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"ronce/src/go/errors"
+)
+
+// Cron is a parsed cron expression, with the standard five fields: minute,
+// hour, day of month, month and day of week. Each field accepts wildcards,
+// lists, ranges and steps, like "*/15 9-17 * * 1-5". The @yearly, @monthly,
+// @weekly, @daily and @hourly shortcuts are also supported.
+type Cron struct {
+	raw    string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	anyDom bool
+	anyDow bool
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(raw string) (c Cron, err error) {
+	return c, c.UnmarshalText([]byte(raw))
+}
+
+func (c Cron) String() string {
+	return c.raw
+}
+
+func (c Cron) IsZero() bool {
+	return c.raw == ""
+}
+
+func (c *Cron) UnmarshalText(raw []byte) (err error) {
+	expr := strings.TrimSpace(string(raw))
+	if shortcut, ok := cronShortcuts[expr]; ok {
+		expr = shortcut
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return errors.Newf(`invalid cron expression %q: expected 5 fields, got %d`, raw, len(fields))
+	}
+
+	var out = Cron{raw: string(raw)}
+	for i, f := range []struct {
+		dst      *uint64
+		min, max int
+	}{
+		{&out.minute, 0, 59},
+		{&out.hour, 0, 23},
+		{&out.dom, 1, 31},
+		{&out.month, 1, 12},
+		{&out.dow, 0, 7},
+	} {
+		*f.dst, err = parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return errors.Wrapf(err, `invalid cron expression %q: field %d`, raw, i+1)
+		}
+	}
+
+	// Sunday can be written either 0 or 7.
+	if out.dow&(1<<7) != 0 {
+		out.dow |= 1
+	}
+	out.anyDom = fields[2] == "*"
+	out.anyDow = fields[4] == "*"
+
+	*c = out
+	return nil
+}
+
+func (c Cron) MarshalText() ([]byte, error) {
+	return []byte(c.raw), nil
+}
+
+// parseCronField returns the bitset of the values matching the field.
+func parseCronField(field string, min, max int) (set uint64, err error) {
+	for _, chunk := range strings.Split(field, ",") {
+		expr, rawStep, hasStep := strings.Cut(chunk, "/")
+
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(rawStep)
+			if err != nil || step <= 0 {
+				return 0, errors.Newf(`invalid step %q`, rawStep)
+			}
+		}
+
+		lo, hi := min, max
+		switch {
+		case expr == "*":
+		case strings.Contains(expr, "-"):
+			rawLo, rawHi, _ := strings.Cut(expr, "-")
+			lo, err = strconv.Atoi(rawLo)
+			if err != nil {
+				return 0, errors.Newf(`invalid range start %q`, rawLo)
+			}
+			hi, err = strconv.Atoi(rawHi)
+			if err != nil {
+				return 0, errors.Newf(`invalid range end %q`, rawHi)
+			}
+		default:
+			lo, err = strconv.Atoi(expr)
+			if err != nil {
+				return 0, errors.Newf(`invalid value %q`, expr)
+			}
+			// A single value with a step means "from the value to the
+			// end of the range".
+			hi = lo
+			if hasStep {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.Newf(`value out of range [%d,%d] in %q`, min, max, chunk)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time strictly after t matching the expression, in
+// the location of t. It returns the zero time if there is none in the next
+// five years, which only happens for impossible dates like February 30.
+func (c Cron) Next(t Time) Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return Time{}
+}
+
+// matchDay follows the cron convention: when both the day of month and the
+// day of week are restricted, a day matching either of them is accepted.
+func (c Cron) matchDay(t Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,55 @@
+package timex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron_Next(t *testing.T) {
+	type Case struct {
+		expr string
+		from string
+		want string
+	}
+	for _, c := range []Case{
+		{`* * * * *`, `2023-05-10T10:20:30Z`, `2023-05-10T10:21:00Z`},
+		{`*/15 * * * *`, `2023-05-10T10:20:00Z`, `2023-05-10T10:30:00Z`},
+		{`0 3 * * *`, `2023-05-10T03:00:00Z`, `2023-05-11T03:00:00Z`},
+		{`@hourly`, `2023-05-10T10:20:00Z`, `2023-05-10T11:00:00Z`},
+		{`@monthly`, `2023-12-10T10:20:00Z`, `2024-01-01T00:00:00Z`},
+		{`30 9 * * 1-5`, `2023-05-12T10:00:00Z`, `2023-05-15T09:30:00Z`},
+		{`0 0 * * 7`, `2023-05-10T00:00:00Z`, `2023-05-14T00:00:00Z`},
+		{`0 0 13 * 5`, `2023-05-10T00:00:00Z`, `2023-05-12T00:00:00Z`},
+		{`0 0 29 2 *`, `2023-03-01T00:00:00Z`, `2024-02-29T00:00:00Z`},
+		{`0 12 1,15 * *`, `2023-05-02T00:00:00Z`, `2023-05-15T12:00:00Z`},
+		{`0 0 30 2 *`, `2023-05-02T00:00:00Z`, `0001-01-01T00:00:00Z`},
+	} {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %s", c.expr, err)
+			continue
+		}
+		from, _ := time.Parse(time.RFC3339, c.from)
+		want, _ := time.Parse(time.RFC3339, c.want)
+		if got := cron.Next(from); !got.Equal(want) {
+			t.Errorf("%q.Next(%s): want %s, got %s", c.expr, c.from, c.want, got.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`* * * *`,
+		`60 * * * *`,
+		`* 24 * * *`,
+		`* * 0 * *`,
+		`*/0 * * * *`,
+		`5-1 * * * *`,
+		`a * * * *`,
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"ronce/src/go/app"
+	"ronce/src/go/errors"
+	"ronce/src/go/log"
+	"ronce/src/go/sql"
+	"ronce/src/go/timex"
+	"ronce/src/go/uuid"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: queue-admin --table <table> [filters] <command> [args]
+
+commands:
+  list               list the jobs matching the filters
+  inspect <id>       display the details and attempts of a job
+  cancel [id...]     cancel the pending and running jobs, with --wait=true
+                     wait for the running jobs to stop
+  retry [id...]      put the unsuccessful jobs back in the pending jobs
+  relane <lane> [id...]
+                     move the jobs that are not running to the lane
+  purge [id...]      delete the finished jobs
+  pause <lane>       stop claiming the jobs of the lane, with --for resume it
+                     automatically after the duration
+  resume <lane>      claim the jobs of the paused lane again
+  paused             list the paused lanes
+
+filters:
+  --lane <lane>      only the jobs of the lane
+  --status <status>  only the jobs with the statuses, comma-separated
+  --older-than <dur> only the jobs created before the duration, like 24h
+`
+
+type Service struct {
+	DB     *sql.DB     `key:"postgres"`
+	Logger *log.Logger `key:"logger" inject-as:"logger"`
+
+	Table        string         `key:"table"        description:"queue table to administrate"`
+	Lane         string         `key:"lane"         default:""      description:"only consider the jobs of the lane"`
+	Statuses     []string       `key:"status"       default:""      description:"only consider the jobs with the statuses"`
+	OlderThan    timex.Duration `key:"older-than"   default:"0s"    description:"only consider the jobs created before the duration"`
+	Limit        int            `key:"limit"        default:"100"   description:"maximum number of jobs listed"`
+	History      bool           `key:"history"      default:"true"  description:"the table has an attempts history table"`
+	Dependencies bool           `key:"dependencies" default:"true"  description:"the table has a dependencies table"`
+	Wait         bool           `key:"wait"         default:"false" description:"wait for the cancelled jobs to reach a final status"`
+	For          timex.Duration `key:"for"          default:"0s"    description:"duration of a lane pause, 0 to pause until resumed"`
+}
+
+func main() {
+	s := new(Service)
+
+	if err := app.Configure(s); err != nil {
+		log.New().Error("starting dependencies", "error", err)
+		os.Exit(1)
+	}
+
+	err := s.run(app.Context(), app.Args())
+	app.Cleanup(s)
+	if err != nil {
+		s.Logger.Error("running command", "err", err)
+		os.Exit(1)
+	}
+}
+
+func (s *Service) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("missing command")
+	}
+
+	queue := sql.Queue{History: s.History, Dependencies: s.Dependencies}
+	filter := sql.JobFilter{Lane: s.Lane, OlderThan: s.OlderThan}
+	for _, status := range s.Statuses {
+		filter.Statuses = append(filter.Statuses, sql.Status(status))
+	}
+
+	command, args := args[0], args[1:]
+
+	// The relane, pause and resume commands take a lane before the ids.
+	var lane string
+	switch command {
+	case "relane", "pause", "resume":
+		if len(args) == 0 {
+			return errors.New("missing lane")
+		}
+		lane, args = args[0], args[1:]
+	}
+
+	for _, arg := range args {
+		id, err := uuid.Parse(arg)
+		if err != nil {
+			return errors.Wrap(err, "parsing job id", "id", arg)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+
+	// Commands changing jobs in bulk must be explicitly scoped, to avoid
+	// updating a whole table by mistake.
+	switch command {
+	case "cancel", "retry", "relane", "purge":
+		if len(filter.IDs) == 0 && filter.Lane == "" && len(filter.Statuses) == 0 && filter.OlderThan == 0 {
+			return errors.Newf("%s requires job ids or filters", command)
+		}
+	}
+
+	var n int64
+	var err error
+	switch command {
+	case "list":
+		jobs, err := queue.List(ctx, s.DB, s.Table, filter, s.Limit)
+		if err != nil {
+			return err
+		}
+		return printJobs(jobs)
+
+	case "inspect":
+		if len(filter.IDs) != 1 {
+			return errors.New("inspect takes exactly one job id")
+		}
+		job, err := queue.Inspect(ctx, s.DB, s.Table, filter.IDs[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(job)
+
+	case "pause":
+		var resumeAt time.Time
+		if s.For > 0 {
+			resumeAt = time.Now().Add(time.Duration(s.For))
+		}
+		return queue.PauseLane(ctx, s.DB, s.Table, lane, resumeAt)
+
+	case "resume":
+		return queue.ResumeLane(ctx, s.DB, s.Table, lane)
+
+	case "paused":
+		lanes, err := queue.PausedLanes(ctx, s.DB, s.Table)
+		if err != nil {
+			return err
+		}
+		return printLanes(lanes)
+
+	case "cancel":
+		if s.Wait {
+			return s.cancelAndWait(ctx, queue, filter.IDs)
+		}
+		n, err = queue.CancelJobs(ctx, s.DB, s.Table, filter)
+	case "retry":
+		n, err = queue.RetryJobs(ctx, s.DB, s.Table, filter)
+	case "relane":
+		n, err = queue.RelaneJobs(ctx, s.DB, s.Table, filter, lane)
+	case "purge":
+		n, err = queue.PurgeJobs(ctx, s.DB, s.Table, filter)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return errors.Newf("unknown command %q", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d jobs\n", command, n)
+	return nil
+}
+
+// cancelAndWait cancels the jobs one by one, waiting for each of them to reach
+// a final status.
+func (s *Service) cancelAndWait(ctx context.Context, queue sql.Queue, ids []uuid.ID) error {
+	if len(ids) == 0 {
+		return errors.New("cancel --wait requires job ids")
+	}
+	for _, id := range ids {
+		status, err := queue.Cancel(ctx, s.DB, s.Table, id, true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", id, status)
+	}
+	return nil
+}
+
+func printJobs(jobs []sql.JobInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLANE\tSTATUS\tTRY\tCREATED\tRUN AT\tLAST ERROR")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			job.ID,
+			job.Lane,
+			job.Status,
+			job.Try,
+			job.CreatedAt.Format(time.RFC3339),
+			job.RunAt.Format(time.RFC3339),
+			job.LastError.String,
+		)
+	}
+	return w.Flush()
+}
+
+func printLanes(lanes []sql.LanePause) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LANE\tPAUSED AT\tRESUME AT")
+	for _, lane := range lanes {
+		resumeAt := "-"
+		if lane.ResumeAt.Valid {
+			resumeAt = lane.ResumeAt.Time.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", lane.Lane, lane.PausedAt.Format(time.RFC3339), resumeAt)
+	}
+	return w.Flush()
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}